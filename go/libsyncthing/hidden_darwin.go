@@ -0,0 +1,14 @@
+package libsyncthing
+
+import "syscall"
+
+// UF_HIDDEN from sys/stat.h; Files.app and Finder skip files with it set
+const ufHidden = 0x8000
+
+func setHidden(path string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return err
+	}
+	return syscall.Chflags(path, int(st.Flags|ufHidden))
+}
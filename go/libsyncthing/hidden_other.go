@@ -0,0 +1,8 @@
+//go:build !darwin
+
+package libsyncthing
+
+// Temp files are already dot files, which is as hidden as it gets here
+func setHidden(string) error {
+	return nil
+}
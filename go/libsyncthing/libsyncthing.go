@@ -2,84 +2,480 @@ package libsyncthing
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
 	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/syncthing/syncthing/lib/config"
+	"github.com/syncthing/syncthing/lib/connections"
+	"github.com/syncthing/syncthing/lib/db"
 	"github.com/syncthing/syncthing/lib/db/backend"
+	"github.com/syncthing/syncthing/lib/discover"
 	"github.com/syncthing/syncthing/lib/events"
 	"github.com/syncthing/syncthing/lib/fs"
+	"github.com/syncthing/syncthing/lib/ignore"
 	"github.com/syncthing/syncthing/lib/locations"
+	"github.com/syncthing/syncthing/lib/logger"
+	"github.com/syncthing/syncthing/lib/model"
+	"github.com/syncthing/syncthing/lib/osutil"
 	"github.com/syncthing/syncthing/lib/protocol"
+	"github.com/syncthing/syncthing/lib/rand"
+	"github.com/syncthing/syncthing/lib/stats"
 	"github.com/syncthing/syncthing/lib/svcutil"
 	"github.com/syncthing/syncthing/lib/syncthing"
 	"github.com/syncthing/syncthing/lib/tlsutil"
 )
 
 var (
-	app       *syncthing.App
-	cfg       config.Wrapper
-	evLogger  events.Logger
-	mu        sync.Mutex
-	myID      protocol.DeviceID
-	dataDir   string
-	running   bool
-	eventLog  []string
-	eventMu   sync.Mutex
+	ErrDeviceIDEmpty         = errors.New("device ID is empty")
+	ErrDeviceIDLength        = errors.New("device ID has wrong length")
+	ErrDeviceIDNoCheckDigits = errors.New("device ID has no check digits")
+	ErrDeviceIDChecksum      = errors.New("device ID check digit incorrect")
+	ErrDeviceIDCharacters    = errors.New("device ID has invalid characters")
+	ErrUnknownFolder         = errors.New("unknown folder")
+	ErrUnknownDevice         = errors.New("unknown device")
+	ErrNotSendReceive        = errors.New("folder is not send-receive")
+	ErrNotReceiveOnly        = errors.New("folder is not receive-only")
+	ErrNoServers             = errors.New("no servers given")
+	ErrNotRunning            = errors.New("sync engine not running")
+	ErrStopTimeout           = errors.New("timed out waiting for sync engine to stop")
+	ErrScanTimeout           = errors.New("timed out waiting for scan to finish")
+	ErrAlreadyRunning        = errors.New("sync engine already running with a different directory")
+	ErrNestedFolderPath      = errors.New("folder path overlaps another folder's path")
+	ErrInvalidFolderPath     = errors.New("folder path is empty or a root")
+	ErrRunning               = errors.New("sync engine is running")
+	ErrInMemory              = errors.New("not possible with an in-memory sync engine")
+
+	errAPINotFound   = errors.New("not found")
+	errTooManyNeeded = errors.New("too many files still to pull to compare with the local index")
+)
+
+// LevelDB's block cache plus write buffer, as lib/db/backend tunes them for
+// small databases and for those over 200 MiB
+const (
+	dbLargeThreshold = 200 << 20
+	dbCacheSmall     = (8 + 16) << 20
+	dbCacheLarge     = (64 + 64) << 20
+)
+
+const defaultLowDiskSpace = 100 << 20
+
+const (
+	defaultCertLifetimeDays = 365 * 20
+	minCertLifetimeDays     = 30
+)
+
+// Battery percentage at or below which SetScanOnBattery(false) pauses folders
+const lowBatteryPercent = 20
+
+// Lifetime per-device byte counts, which Syncthing itself doesn't keep
+const deviceBytesFile = "device-bytes.json"
+
+// What observer mode replaced in each folder, see SetFolderObserverMode
+const observersFile = "observers.json"
+
+// When each folder was last in sync, see GetTimeSinceLastSync
+const lastSyncedFile = "last-synced.json"
+
+var (
+	app      *syncthing.App
+	cfg      config.Wrapper
+	evLogger events.Logger
+	mu       sync.Mutex
+	myID     protocol.DeviceID
+	dataDir  string
+	dbPath   string
+	dbCache  int64
+	ldb      backend.Backend
+	running  bool
+	stopping <-chan struct{} // closed once the last stopApp has finished
+	launched <-chan struct{} // closed once app.Start has returned
+	quit     chan struct{}   // closed when stopApp starts stopping the engine
+
+	// Set by StartInMemory, along with the temporary directory holding what
+	// Syncthing insists on writing to disk
+	inMemory      bool
+	memoryBaseDir string
+
+	// Validity of newly generated device certificates
+	certLifetimeDays = defaultCertLifetimeDays
+
+	// Certificate and key from ImportIdentity, written out by the next Start
+	importedCert []byte
+	importedKey  []byte
+
+	// When cleared, config changes wait for SaveConfig or Stop
+	autoSave = true
+
+	// Config schema version found on disk at the last load, before
+	// migration; zero when a new config was created
+	cfgLoadedVersion int
+
+	eventLog []string
+	eventMu  sync.Mutex
+
+	// Service failures from Syncthing's log, guarded by eventMu
+	serviceFailures []serviceFailure
+	failureHookOnce sync.Once
+
+	// Engine events seen since Start by type, guarded by eventMu
+	eventCounts = make(map[events.EventType]int)
+
+	// Loopback REST API, see enableLocalAPI
+	apiAddr   string
+	apiKey    string
+	apiClient = &http.Client{Timeout: 30 * time.Second}
+
+	// Scans only answer once they've finished, however long that takes
+	scanClient = &http.Client{}
+
+	// When set, AddDevice rejects IDs that ValidateDeviceID would reject
+	strictDeviceIDs bool
+
+	// When set, a panic while starting the engine is re-raised instead of
+	// recovered, see SetPanicMode
+	crashOnPanic bool
+
+	// Connections that receive nothing for this long are redialed; zero
+	// leaves it to Syncthing's own receive timeout
+	keepAliveInterval time.Duration
+
+	// Bounds of the shared redial backoff, see SetReconnectBackoff, the
+	// configured interval it replaced and the channel that stops it
+	reconnectMin      time.Duration
+	reconnectMax      time.Duration
+	reconnectOriginal int
+	reconnectStop     chan struct{}
+
+	// Folders whose pull temp files get the hidden flag
+	hideTempFolders = make(map[string]bool)
+
+	// Per-folder throttling windows, see SetFolderBandwidthWindow, and the
+	// devices' own rate limits from before a window throttled them
+	bandwidthWindows map[string]bandwidthWindow
+	windowOriginals  = make(map[protocol.DeviceID]rateLimits)
+
+	// Devices an introducer may not add to a folder, by folder ID, see
+	// SetFolderNoAutoShareDevices
+	noAutoShare = make(map[string]map[protocol.DeviceID]bool)
+
+	// Folders scanned in chunks, see SetFolderScanTimeLimit
+	scanLimits = make(map[string]*scanLimit)
+
+	// Folders in observer mode, see SetFolderObserverMode
+	observers = make(map[string]*observerFolder)
+
+	// Our own local discovery announcements, see SetLocalAnnounceInterval,
+	// the channel that stops them and whether Syncthing's were turned off
+	// in their favour
+	localAnnounceInterval time.Duration
+	localAnnounceStop     chan struct{}
+	localAnnounceOwned    bool
+
+	// Battery state from NotifyBatteryLevel and the folders paused for it,
+	// see SetScanOnBattery
+	scanOnBattery = true
+	batteryLow    bool
+	batteryPaused = make(map[string]bool)
+
+	// Free space below which LowDiskSpaceHandler is told, per folder
+	lowDiskSpace int64 = defaultLowDiskSpace
+
+	// Callbacks into the app, guarded by handlerMu
+	handlerMu        sync.Mutex
+	connHandler      ConnectionHandler
+	outOfSyncHandler OutOfSyncHandler
+	lowSpaceHandler  LowDiskSpaceHandler
+	scanHandler      ScanHandler
+
+	// State derived from the event stream, guarded by stateMu
+	stateMu       sync.Mutex
+	indexProgress map[protocol.DeviceID]*deviceIndexProgress
+	summaries     map[string]*model.FolderSummary
+	connected     map[protocol.DeviceID]bool
+	denied        map[protocol.DeviceID]*deniedConnection
+	reportedNames map[protocol.DeviceID]string
+	byteSamples   map[protocol.DeviceID]protocol.Statistics
+	connSamples   map[protocol.DeviceID]protocol.Statistics
+	lifetimeBytes map[string]*byteTotals               // by device ID, as stored in deviceBytesFile
+	remoteNeed    map[string]map[protocol.DeviceID]int // folder -> device -> items they need from us
+	outOfSync     map[string]string                    // folder -> last reported reason
+	localSeen     map[protocol.DeviceID]time.Time      // last local discovery announcement
+	scanPercent   map[string]float64                   // folder -> hashing progress while scanning
+	lastSynced    map[string]time.Time                 // folder -> last idle summary with nothing needed, as stored in lastSyncedFile
+	syncedDirty   bool                                 // lastSynced changed since it was saved
+	scanChanges   map[string]*scanCounts               // folder -> files changed by the running scan
+	scanTriggers  map[string]string                    // folder -> what started the last scan
+	timerScanAt   map[string]time.Time                 // folder -> start of the last startup or interval scan
+	manualScanAt  map[string]time.Time                 // folder -> when ScanSubpaths asked for a scan
+	conflicts     map[string]folderConflicts           // folder -> conflict files at a summary sequence
+	savedCfg      config.Configuration                 // as last written to disk
+	inBytesAt     time.Time                            // when inBytes was sampled for downloadRate
+	inBytes       int64
+	inRate        float64
 )
 
+// ConnectionHandler is notified as peers connect and disconnect. connType
+// is Syncthing's connection type, e.g. "tcp-client" or "relay-server".
+type ConnectionHandler interface {
+	OnConnected(deviceID, address, connType string)
+	OnDisconnected(deviceID, reason string)
+}
+
+// OutOfSyncHandler is told when a folder settles below full sync and why:
+// "errors", "peer offline" or "local changes pending".
+type OutOfSyncHandler interface {
+	OnOutOfSync(folderID, reason string)
+}
+
+// ScanHandler is told when a folder finishes a scan, with how many files
+// the scan found new or changed and how many it found deleted.
+type ScanHandler interface {
+	OnScanComplete(folderID string, newFiles, deletedFiles int)
+}
+
+// DoneHandler is told when a background operation such as StopAsync has
+// finished.
+type DoneHandler interface {
+	OnDone()
+}
+
+// LowDiskSpaceHandler is told when free space on a syncing folder's
+// filesystem drops below the threshold set by SetLowDiskSpaceThreshold.
+type LowDiskSpaceHandler interface {
+	OnLowDiskSpace(folderID string, freeBytes int64)
+}
+
+type deviceIndexProgress struct {
+	Started    time.Time                       `json:"started"`
+	LastUpdate time.Time                       `json:"lastUpdate"`
+	Items      int                             `json:"items"`
+	Folders    map[string]*folderIndexProgress `json:"folders"`
+}
+
+type folderIndexProgress struct {
+	Items       int     `json:"items"`
+	Sequence    int64   `json:"sequence"`
+	GlobalItems int     `json:"globalItems"`
+	Completion  float64 `json:"completion"`
+}
+
+type deniedConnection struct {
+	DeviceID string    `json:"deviceID"`
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+}
+
+type bandwidthWindow struct {
+	start, end       int // local hours, end exclusive; wraps past midnight when end < start
+	downKBps, upKBps int
+}
+
+type rateLimits struct{ down, up int } // KB/s, 0 for unlimited
+
+func (w bandwidthWindow) active(t time.Time) bool {
+	h := t.Hour()
+	if w.start < w.end {
+		return h >= w.start && h < w.end
+	}
+	return h >= w.start || h < w.end
+}
+
+type byteTotals struct {
+	InBytes  int64 `json:"inBytes"`
+	OutBytes int64 `json:"outBytes"`
+}
+
+type fileCounts struct {
+	Files       int `json:"files"`
+	Directories int `json:"directories"`
+	Symlinks    int `json:"symlinks"`
+	Deleted     int `json:"deleted"`
+}
+
 func Start(dir string) error {
+	return start(dir, false)
+}
+
+// StartInMemory starts an engine that keeps its database, configuration
+// and certificate in memory, for tests and simulators. Folders added with
+// SetFolder live on Syncthing's fake filesystem. Everything is gone after
+// Stop. Syncthing's REST API still keeps its HTTPS certificate and CSRF
+// tokens on disk, so those go to a temporary directory removed on Stop.
+func StartInMemory() (string, error) {
+	if err := start("", true); err != nil {
+		return "", err
+	}
+	return GetDeviceID(), nil
+}
+
+func start(dir string, memory bool) error {
 	mu.Lock()
 
-	if running {
-		mu.Unlock()
-		return nil
+	for {
+		if running {
+			same := memory == inMemory && (memory || filepath.Clean(dir) == filepath.Clean(dataDir))
+			mu.Unlock()
+			if !same {
+				return ErrAlreadyRunning
+			}
+			return nil
+		}
+
+		// An engine still shutting down holds the database lock. Wait for
+		// it without mu so a hung shutdown doesn't block the whole API,
+		// then look again in case another Start got in first.
+		ch := stopping
+		if ch == nil {
+			break
+		}
+		select {
+		case <-ch:
+		default:
+			mu.Unlock()
+			<-ch
+			mu.Lock()
+			continue
+		}
+		break
 	}
 
+	inMemory = memory
 	dataDir = dir
-	if err := os.MkdirAll(dataDir, 0700); err != nil {
+	baseDir := dataDir
+	started := false
+	if memory {
+		var err error
+		baseDir, err = os.MkdirTemp("", "libsyncthing-")
+		if err != nil {
+			mu.Unlock()
+			return err
+		}
+		memoryBaseDir = baseDir
+		// Stop only cleans up after an engine that got going
+		defer func() {
+			if started {
+				return
+			}
+			mu.Lock()
+			if memoryBaseDir == baseDir {
+				memoryBaseDir = ""
+			}
+			mu.Unlock()
+			os.RemoveAll(baseDir)
+		}()
+	} else if err := os.MkdirAll(dataDir, 0700); err != nil {
 		mu.Unlock()
 		return err
 	}
 
 	// Initialize locations package so Syncthing internals use our data directory
-	if err := locations.SetBaseDir(locations.ConfigBaseDir, dataDir); err != nil {
+	if err := locations.SetBaseDir(locations.ConfigBaseDir, baseDir); err != nil {
 		mu.Unlock()
 		return err
 	}
-	if err := locations.SetBaseDir(locations.DataBaseDir, dataDir); err != nil {
+	if err := locations.SetBaseDir(locations.DataBaseDir, baseDir); err != nil {
 		mu.Unlock()
 		return err
 	}
 
-	certFile := filepath.Join(dataDir, "cert.pem")
-	keyFile := filepath.Join(dataDir, "key.pem")
-
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	var cert tls.Certificate
+	var err error
+	if memory {
+		cert, err = tlsutil.NewCertificateInMemory("syncthing", certLifetimeDays)
+	} else {
+		cert, err = loadIdentity(dataDir)
+	}
 	if err != nil {
-		cert, err = tlsutil.NewCertificate(certFile, keyFile, "syncthing", 365*20)
-		if err != nil {
-			mu.Unlock()
-			return err
-		}
+		mu.Unlock()
+		return err
 	}
-
 	myID = protocol.NewDeviceID(cert.Certificate[0])
 
 	evLogger = events.NewLogger()
 	go evLogger.Serve(context.Background())
 
+	eventMu.Lock()
+	serviceFailures = nil
+	eventCounts = make(map[events.EventType]int)
+	eventMu.Unlock()
+	failureHookOnce.Do(func() {
+		logger.DefaultLogger.AddHandler(logger.LevelInfo, recordServiceFailure)
+	})
+
+	stateMu.Lock()
+	indexProgress = make(map[protocol.DeviceID]*deviceIndexProgress)
+	summaries = make(map[string]*model.FolderSummary)
+	connected = make(map[protocol.DeviceID]bool)
+	remoteNeed = make(map[string]map[protocol.DeviceID]int)
+	outOfSync = make(map[string]string)
+	localSeen = make(map[protocol.DeviceID]time.Time)
+	scanPercent = make(map[string]float64)
+	lastSynced = make(map[string]time.Time)
+	syncedDirty = false
+	scanChanges = make(map[string]*scanCounts)
+	scanTriggers = make(map[string]string)
+	timerScanAt = make(map[string]time.Time)
+	manualScanAt = make(map[string]time.Time)
+	conflicts = make(map[string]folderConflicts)
+	denied = make(map[protocol.DeviceID]*deniedConnection)
+	reportedNames = make(map[protocol.DeviceID]string)
+	byteSamples = make(map[protocol.DeviceID]protocol.Statistics)
+	lifetimeBytes = make(map[string]*byteTotals)
+	if !memory {
+		if data, err := os.ReadFile(filepath.Join(dataDir, deviceBytesFile)); err == nil {
+			json.Unmarshal(data, &lifetimeBytes)
+		}
+		if data, err := os.ReadFile(filepath.Join(dataDir, lastSyncedFile)); err == nil {
+			json.Unmarshal(data, &lastSynced)
+		}
+	}
+	inBytesAt = time.Time{}
+	connSamples = make(map[protocol.DeviceID]protocol.Statistics)
+	stateMu.Unlock()
+
+	observers = make(map[string]*observerFolder)
+	if !memory {
+		if data, err := os.ReadFile(filepath.Join(dataDir, observersFile)); err == nil {
+			json.Unmarshal(data, &observers)
+		}
+	}
+
 	cfgPath := filepath.Join(dataDir, "config.xml")
+	if memory {
+		// No path makes configFile skip saving
+		cfgPath = ""
+	}
 
 	// Load existing config to preserve sync state, or create new on first launch
+	cfgLoadedVersion = 0
 	if _, statErr := os.Stat(cfgPath); statErr == nil {
-		cfg, _, err = config.Load(cfgPath, myID, evLogger)
+		cfg, cfgLoadedVersion, err = loadConfig(cfgPath, myID, evLogger)
 		if err != nil {
+			cfgLoadedVersion = 0
 			addEvent(fmt.Sprintf("Config load failed, recreating: %v", err))
 			cfg, err = defaultConfig(cfgPath, myID, evLogger)
 			if err != nil {
@@ -95,191 +491,6195 @@ func Start(dir string) error {
 		}
 	}
 
-	// Start config service - Syncthing's cfg.Modify() sends to a queue
-	// that cfg.Serve() processes. Without this, any Modify() call deadlocks.
-	go cfg.Serve(context.Background())
+	// Start config service - Syncthing's cfg.Modify() sends to a queue
+	// that cfg.Serve() processes. Without this, any Modify() call deadlocks.
+	go cfg.Serve(context.Background())
+	cfg.Subscribe(shareGuard{})
+
+	stateMu.Lock()
+	savedCfg = cfg.RawCopy()
+	stateMu.Unlock()
+
+	if err := applyBatteryPolicy(); err != nil {
+		addEvent(fmt.Sprintf("Battery policy failed: %v", err))
+	}
+	if err := applyScanLimits(); err != nil {
+		addEvent(fmt.Sprintf("Scan time limits failed: %v", err))
+	}
+	// The new config has the devices' own limits and reconnect interval
+	// again
+	windowOriginals = make(map[protocol.DeviceID]rateLimits)
+	reconnectMin, reconnectMax, reconnectStop = 0, 0, nil
+	if err := applyBandwidthWindows(time.Now()); err != nil {
+		addEvent(fmt.Sprintf("Bandwidth window: %v", err))
+	}
+
+	if err := enableLocalAPI(); err != nil {
+		mu.Unlock()
+		return err
+	}
+
+	dbPath = ""
+	dbCache = dbCacheSmall
+	if memory {
+		ldb = backend.OpenMemory()
+	} else {
+		dbPath = filepath.Join(dataDir, "index-v0.14.0.db")
+		if dirSize(dbPath) > dbLargeThreshold {
+			dbCache = dbCacheLarge
+		}
+		ldb, err = backend.OpenLevelDB(dbPath, backend.TuningAuto)
+		if err != nil {
+			mu.Unlock()
+			return err
+		}
+	}
+
+	app, err = syncthing.New(cfg, ldb, evLogger, cert, syncthing.Options{
+		NoUpgrade: true,
+	})
+	if err != nil {
+		mu.Unlock()
+		return err
+	}
+
+	running = true
+	started = true
+	a := app
+	done := make(chan struct{})
+	launched = done
+	quit = make(chan struct{})
+	if keepAliveInterval != 0 {
+		go watchConnections(quit)
+	}
+	if bandwidthWindows != nil {
+		go watchBandwidthWindows(quit)
+	}
+	mu.Unlock()
+
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				addEvent(fmt.Sprintf("PANIC: %v\n%s", r, debug.Stack()))
+				mu.Lock()
+				running = false
+				app = nil
+				ldb = nil
+				crash := crashOnPanic
+				mu.Unlock()
+				if crash {
+					panic(r)
+				}
+			}
+		}()
+
+		err := a.Start()
+		if err != nil {
+			addEvent(fmt.Sprintf("Start error: %v", err))
+			mu.Lock()
+			running = false
+			app = nil
+			ldb = nil
+			mu.Unlock()
+			return
+		}
+		addEvent("Sync engine started")
+		go listenEvents()
+		go pollSummaries()
+		go watchDiskSpace()
+		go watchScanLimits()
+	}()
+
+	return nil
+}
+
+// loadIdentity returns the device certificate in dir, writing out one from
+// ImportIdentity or generating a new one first as needed. Must be called
+// with mu held.
+func loadIdentity(dir string) (tls.Certificate, error) {
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if importedCert != nil {
+		if err := os.WriteFile(certFile, importedCert, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := os.WriteFile(keyFile, importedKey, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		importedCert, importedKey = nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tlsutil.NewCertificate(certFile, keyFile, "syncthing", certLifetimeDays)
+	}
+	return cert, nil
+}
+
+// SetPanicMode chooses what happens when the engine panics while starting:
+// "recover", the default, logs it and leaves the engine stopped; "crash"
+// re-panics after logging so the process dies with a full crash report.
+func SetPanicMode(mode string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	switch mode {
+	case "recover":
+		crashOnPanic = false
+	case "crash":
+		crashOnPanic = true
+	default:
+		return fmt.Errorf("unknown panic mode %q", mode)
+	}
+	return nil
+}
+
+// SetCertificateLifetimeDays sets how long a newly generated device
+// certificate is valid, 20 years by default. An existing certificate is
+// kept as it is. Must be called before Start.
+func SetCertificateLifetimeDays(days int) error {
+	if days < minCertLifetimeDays {
+		return fmt.Errorf("certificate lifetime must be at least %d days, got %d", minCertLifetimeDays, days)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if running {
+		return ErrRunning
+	}
+	certLifetimeDays = days
+	return nil
+}
+
+// ImportIdentity replaces the device certificate and key with the given PEM
+// pair, so a device moved over from another Syncthing install keeps its
+// device ID. Must be called before Start, which writes them to the data
+// directory.
+func ImportIdentity(certPEM, keyPEM string) error {
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if running {
+		return ErrRunning
+	}
+	importedCert = []byte(certPEM)
+	importedKey = []byte(keyPEM)
+	myID = protocol.NewDeviceID(cert.Certificate[0])
+	return nil
+}
+
+// Initialize prepares dir for a later Start without starting the engine:
+// it creates the device certificate and configuration if they are missing,
+// sets our device name unless deviceName is empty, and returns our device
+// ID.
+func Initialize(dir, deviceName string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if running {
+		return "", ErrRunning
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	cert, err := loadIdentity(dir)
+	if err != nil {
+		return "", err
+	}
+	myID = protocol.NewDeviceID(cert.Certificate[0])
+
+	cfgPath := filepath.Join(dir, "config.xml")
+	w, _, err := loadConfig(cfgPath, myID, events.NoopLogger)
+	if err != nil {
+		w, err = defaultConfig(cfgPath, myID, events.NoopLogger)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if deviceName != "" {
+		// Without Serve running the wrapper can't Modify, so edit a copy
+		c := w.RawCopy()
+		for i := range c.Devices {
+			if c.Devices[i].DeviceID == myID {
+				c.Devices[i].Name = deviceName
+			}
+		}
+		if err := newConfigFile(cfgPath, c, myID, events.NoopLogger).write(); err != nil {
+			return "", err
+		}
+	}
+	return myID.String(), nil
+}
+
+// StartEmpty starts the engine like Start and returns our device ID, so
+// onboarding can show the ID before any folders or devices are provisioned.
+// A fresh data directory starts with no folders; an existing configuration
+// is kept as is.
+func StartEmpty(dir string) (string, error) {
+	if err := Start(dir); err != nil {
+		return "", err
+	}
+	return GetDeviceID(), nil
+}
+
+// MigrateDataDir moves the config, certificates and database from the
+// current data directory to newDir and restarts the engine there if it was
+// running. Files already moved are put back if any step fails, including
+// the restart.
+func MigrateDataDir(newDir string) error {
+	mu.Lock()
+	oldDir := dataDir
+	wasRunning := running
+	if inMemory {
+		mu.Unlock()
+		return ErrInMemory
+	}
+	if oldDir == "" {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	if filepath.Clean(newDir) == filepath.Clean(oldDir) {
+		mu.Unlock()
+		return nil
+	}
+	stopped := stopApp()
+	mu.Unlock()
+
+	// A shutdown can take a while, or hang after a StopWithTimeout, so
+	// wait without mu; a Start meanwhile leaves the files in use
+	<-stopped
+	mu.Lock()
+	restarted := running
+	mu.Unlock()
+	if restarted {
+		return ErrRunning
+	}
+
+	moved, err := moveDataFiles(oldDir, newDir)
+	if err == nil && wasRunning {
+		err = Start(newDir)
+	}
+	if err != nil {
+		for i := len(moved) - 1; i >= 0; i-- {
+			moveFile(moved[i][1], moved[i][0])
+		}
+		os.Remove(filepath.Join(newDir, filepath.Base(dbPath)))
+		if wasRunning {
+			if startErr := Start(oldDir); startErr != nil {
+				addEvent(fmt.Sprintf("Restart after failed migration: %v", startErr))
+			}
+		}
+		return err
+	}
+	os.Remove(filepath.Join(oldDir, filepath.Base(dbPath)))
+	if !wasRunning {
+		mu.Lock()
+		dataDir = newDir
+		mu.Unlock()
+	}
+	return nil
+}
+
+// moveDataFiles moves our files from oldDir to newDir after checking there
+// is room for them, returning the (from, to) pairs it managed to move.
+func moveDataFiles(oldDir, newDir string) ([][2]string, error) {
+	if err := os.MkdirAll(newDir, 0700); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, name := range []string{"config.xml", "cert.pem", "key.pem", "https-cert.pem", "https-key.pem", deviceBytesFile, observersFile, lastSyncedFile} {
+		if _, err := os.Stat(filepath.Join(oldDir, name)); err == nil {
+			files = append(files, name)
+		}
+	}
+	dbDir := filepath.Base(dbPath)
+	if entries, err := os.ReadDir(filepath.Join(oldDir, dbDir)); err == nil {
+		if err := os.MkdirAll(filepath.Join(newDir, dbDir), 0700); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dbDir, entry.Name()))
+			}
+		}
+	}
+
+	// Renames within a filesystem need no room of their own
+	if !sameFilesystem(oldDir, newDir) {
+		var need int64
+		for _, name := range files {
+			if info, err := os.Stat(filepath.Join(oldDir, name)); err == nil {
+				need += info.Size()
+			}
+		}
+		usage, err := fs.NewFilesystem(fs.FilesystemTypeBasic, newDir).Usage(".")
+		if err != nil {
+			return nil, err
+		}
+		if uint64(need) > usage.Free {
+			return nil, fmt.Errorf("not enough space in %s: need %d bytes, %d free", newDir, need, usage.Free)
+		}
+	}
+
+	var moved [][2]string
+	for _, name := range files {
+		from, to := filepath.Join(oldDir, name), filepath.Join(newDir, name)
+		if err := moveFile(from, to); err != nil {
+			return moved, err
+		}
+		moved = append(moved, [2]string{from, to})
+	}
+	return moved, nil
+}
+
+// sameFilesystem reports whether files in a can be renamed into b, by
+// trying it with an empty scratch file.
+func sameFilesystem(a, b string) bool {
+	fd, err := os.CreateTemp(a, ".migrate-")
+	if err != nil {
+		return false
+	}
+	from := fd.Name()
+	fd.Close()
+	to := filepath.Join(b, filepath.Base(from))
+	if err := os.Rename(from, to); err != nil {
+		os.Remove(from)
+		return false
+	}
+	os.Remove(to)
+	return true
+}
+
+// moveFile renames from to to, copying across filesystems when a rename
+// isn't possible.
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(to)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
+
+func dirSize(dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func defaultConfig(cfgPath string, myID protocol.DeviceID, evLogger events.Logger) (config.Wrapper, error) {
+	newCfg := config.New(myID)
+	newCfg.GUI.Enabled = false
+
+	// Enable local discovery so phone and desktop find each other on same WiFi
+	newCfg.Options.LocalAnnEnabled = true
+	// Listen on a dynamic TCP port for incoming connections
+	newCfg.Options.RawListenAddresses = []string{"tcp://0.0.0.0:0"}
+
+	// Keep these disabled for iOS simplicity
+	newCfg.Options.GlobalAnnEnabled = false
+	newCfg.Options.RelaysEnabled = false
+	newCfg.Options.NATEnabled = false
+	newCfg.Options.CREnabled = false
+
+	wrapper := newConfigFile(cfgPath, newCfg, myID, evLogger)
+	if err := wrapper.write(); err != nil {
+		return nil, err
+	}
+	return wrapper, nil
+}
+
+func loadConfig(cfgPath string, myID protocol.DeviceID, evLogger events.Logger) (config.Wrapper, int, error) {
+	fd, err := os.Open(cfgPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+
+	c, version, err := config.ReadXML(fd, myID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return newConfigFile(cfgPath, c, myID, evLogger), version, nil
+}
+
+// configFile takes over saving from Syncthing's config wrapper so saves can
+// be held back, see SetAutoSave. The wrapped one has no path, which turns
+// its own save after every change into a no-op.
+type configFile struct {
+	config.Wrapper
+	path     string
+	evLogger events.Logger
+
+	mut      sync.Mutex
+	autoSave bool
+	dirty    bool
+	timer    *time.Timer
+
+	// Changes meant for this run only, by key, each with a func undoing
+	// it in what gets written out
+	runtimeOnly map[string]func(*config.Configuration)
+
+	// Where folders auto-accepted from a device go, see
+	// SetDeviceDefaultFolderPath
+	acceptPaths map[protocol.DeviceID]string
+}
+
+// Same batching as Syncthing's own wrapper
+const configSaveDelay = 5 * time.Second
+
+func newConfigFile(cfgPath string, c config.Configuration, myID protocol.DeviceID, evLogger events.Logger) *configFile {
+	f := &configFile{
+		Wrapper:  config.Wrap("", c, myID, evLogger),
+		path:     cfgPath,
+		evLogger: evLogger,
+		autoSave: autoSave,
+	}
+	f.Subscribe(f)
+	return f
+}
+
+func (f *configFile) ConfigPath() string {
+	return f.path
+}
+
+func (f *configFile) String() string {
+	return "configFile@" + f.path
+}
+
+// CommitConfiguration schedules a save after a change, like Syncthing's
+// wrapper does.
+func (f *configFile) CommitConfiguration(_, _ config.Configuration) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	f.dirty = true
+	if f.autoSave && f.timer == nil {
+		f.timer = time.AfterFunc(configSaveDelay, func() {
+			if err := f.Save(); err != nil {
+				addEvent(fmt.Sprintf("Config save failed: %v", err))
+			}
+		})
+	}
+	return true
+}
+
+// Save writes the configuration out, or only notes that it needs writing
+// while auto-save is off.
+func (f *configFile) Save() error {
+	f.mut.Lock()
+	if !f.autoSave {
+		f.dirty = true
+		f.mut.Unlock()
+		return nil
+	}
+	f.mut.Unlock()
+	return f.write()
+}
+
+// diskCopy returns the configuration as write saves it, with every
+// runtime-only change undone. Must be called with f.mut held.
+func (f *configFile) diskCopy() config.Configuration {
+	c := f.RawCopy()
+	for _, undo := range f.runtimeOnly {
+		undo(&c)
+	}
+	return c
+}
+
+// setRuntimeOnly registers undo to be applied to the configuration before
+// every write, so the change it undoes never reaches the disk. A nil undo
+// drops the key.
+func (f *configFile) setRuntimeOnly(key string, undo func(*config.Configuration)) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if undo == nil {
+		delete(f.runtimeOnly, key)
+		return
+	}
+	if f.runtimeOnly == nil {
+		f.runtimeOnly = make(map[string]func(*config.Configuration))
+	}
+	f.runtimeOnly[key] = undo
+}
+
+// Modify is the wrapper's Modify, except that folders Syncthing auto-accepts
+// from a device with its own base path are moved there before they start.
+func (f *configFile) Modify(fn config.ModifyFunction) (config.Waiter, error) {
+	return f.Wrapper.Modify(func(c *config.Configuration) {
+		f.mut.Lock()
+		moving := len(f.acceptPaths) > 0
+		f.mut.Unlock()
+		if !moving {
+			fn(c)
+			return
+		}
+		before := c.FolderMap()
+		fn(c)
+		f.moveAccepted(c, before)
+	})
+}
+
+// moveAccepted moves the folders fn added that look auto-accepted: shared
+// last with a device that has a base path, in a new directory right under
+// the default folder path.
+func (f *configFile) moveAccepted(c *config.Configuration, before map[string]config.FolderConfiguration) {
+	defaultPath, err := fs.ExpandTilde(c.Defaults.Folder.Path)
+	if err != nil {
+		return
+	}
+
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	for i := range c.Folders {
+		fcfg := &c.Folders[i]
+		if _, ok := before[fcfg.ID]; ok || len(fcfg.Devices) == 0 || fcfg.FilesystemType != fs.FilesystemTypeBasic {
+			continue
+		}
+		from := fcfg.Devices[len(fcfg.Devices)-1].DeviceID
+		base, ok := f.acceptPaths[from]
+		if !ok {
+			continue
+		}
+		path, err := fs.ExpandTilde(fcfg.Path)
+		if err != nil || filepath.Dir(path) != filepath.Clean(defaultPath) {
+			continue
+		}
+
+		to := filepath.Join(base, filepath.Base(path))
+		if _, err := os.Lstat(to); !os.IsNotExist(err) {
+			addEvent(fmt.Sprintf("Auto-accept %s: %s is taken, keeping %s", fcfg.ID, to, path))
+			continue
+		}
+		if err := os.MkdirAll(base, 0700); err != nil {
+			addEvent(fmt.Sprintf("Auto-accept %s: %v", fcfg.ID, err))
+			continue
+		}
+		// Syncthing has only just created the directory, ignores and all
+		if err := os.Rename(path, to); err != nil {
+			addEvent(fmt.Sprintf("Auto-accept %s: %v", fcfg.ID, err))
+			continue
+		}
+		fcfg.Path = to
+		addEvent(fmt.Sprintf("Auto-accepted %s from %s at %s", fcfg.ID, from.Short(), to))
+	}
+}
+
+func (f *configFile) setAcceptPath(id protocol.DeviceID, base string) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if base == "" {
+		delete(f.acceptPaths, id)
+		return
+	}
+	if f.acceptPaths == nil {
+		f.acceptPaths = make(map[protocol.DeviceID]string)
+	}
+	f.acceptPaths[id] = base
+}
+
+func (f *configFile) setAutoSave(enabled bool) error {
+	f.mut.Lock()
+	f.autoSave = enabled
+	dirty := f.dirty
+	f.mut.Unlock()
+
+	if enabled && dirty {
+		return f.write()
+	}
+	return nil
+}
+
+// write saves the configuration regardless of auto-save. Without a path,
+// as for StartInMemory, there is nothing to save to.
+func (f *configFile) write() error {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	if f.path == "" {
+		f.dirty = false
+		return nil
+	}
+	c := f.diskCopy()
+	fd, err := osutil.CreateAtomic(f.path)
+	if err != nil {
+		return err
+	}
+	if err := c.WriteXML(osutil.LineEndingsWriter(fd)); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	f.dirty = false
+	f.evLogger.Log(events.ConfigSaved, c)
+	return nil
+}
+
+// enableLocalAPI points the GUI/REST listener at a free loopback port with a
+// fresh API key. lib/syncthing doesn't expose the model, so anything beyond
+// config and events goes through the REST API; Syncthing also only runs its
+// folder summary service when the GUI is enabled. Must be called with mu
+// held, after cfg.Serve has started.
+func enableLocalAPI() error {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	key := rand.String(32)
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		c.GUI.Enabled = true
+		c.GUI.RawAddress = addr
+		c.GUI.RawUseTLS = false
+		c.GUI.APIKey = key
+	})
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+
+	apiAddr = addr
+	apiKey = key
+	return nil
+}
+
+// apiRequest calls the loopback REST API and decodes the JSON response into
+// out, if non-nil. body, if non-nil, is sent as JSON. Must not be called
+// with mu held.
+func apiRequest(method, path string, query url.Values, body, out interface{}) error {
+	return apiRequestWith(apiClient, method, path, query, body, out)
+}
+
+// apiRequestWith is apiRequest over the given client.
+func apiRequestWith(client *http.Client, method, path string, query url.Values, body, out interface{}) error {
+	mu.Lock()
+	addr, key, ok := apiAddr, apiKey, running
+	mu.Unlock()
+	if !ok || addr == "" {
+		return ErrNotRunning
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = strings.NewReader(string(data))
+	}
+
+	u := url.URL{Scheme: "http", Host: addr, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", key)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%s: %w: %s", path, errAPINotFound, strings.TrimSpace(string(msg)))
+		}
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// pollSummaries keeps FolderSummary events coming. Syncthing only computes
+// summaries while someone has asked for them on /rest/events within the last
+// minute.
+func pollSummaries() {
+	query := url.Values{
+		"events":  {"FolderSummary,FolderCompletion"},
+		"limit":   {"1"},
+		"timeout": {"0"},
+	}
+	for {
+		if err := apiRequest(http.MethodGet, "/rest/events", query, nil, nil); err == ErrNotRunning {
+			return
+		}
+		if conns, err := getConnections(); err == nil {
+			recordDeviceBytes(conns)
+		}
+		mu.Lock()
+		dir := dataDir
+		mu.Unlock()
+		saveLastSynced(dir)
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// saveLastSynced writes the folders' last sync times to dir if they
+// changed. Does nothing without a data directory.
+func saveLastSynced(dir string) {
+	stateMu.Lock()
+	var data []byte
+	if syncedDirty && dir != "" {
+		data, _ = json.Marshal(lastSynced)
+		syncedDirty = false
+	}
+	stateMu.Unlock()
+
+	if data != nil {
+		if err := writeFileAtomic(filepath.Join(dir, lastSyncedFile), data); err != nil {
+			addEvent(fmt.Sprintf("Saving last sync times: %v", err))
+		}
+	}
+}
+
+func Stop() {
+	mu.Lock()
+	ch := stopApp()
+	mu.Unlock()
+
+	<-ch
+}
+
+// StopWithTimeout stops the engine like Stop but gives up waiting after ms
+// milliseconds, returning ErrStopTimeout. Shutdown carries on in the
+// background; the engine is considered stopped either way, and a Start
+// meanwhile waits for the shutdown to finish.
+func StopWithTimeout(ms int) error {
+	mu.Lock()
+	ch := stopApp()
+	mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		addEvent(fmt.Sprintf("Warning: engine did not stop within %dms", ms))
+		return ErrStopTimeout
+	}
+}
+
+// stopApp starts shutting down the engine and returns a channel that is
+// closed once it has stopped. Must be called with mu held.
+func stopApp() <-chan struct{} {
+	if f, ok := cfg.(*configFile); ok {
+		if err := f.write(); err != nil {
+			addEvent(fmt.Sprintf("Config save failed: %v", err))
+		}
+	}
+	saveLastSynced(dataDir)
+
+	a := app
+	app = nil
+	ldb = nil
+	running = false
+	if quit != nil {
+		close(quit)
+		quit = nil
+	}
+	localAnnounceInterval = 0
+	localAnnounceStop = nil
+	localAnnounceOwned = false
+	tmpDir := memoryBaseDir
+	memoryBaseDir = ""
+
+	if a == nil {
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+		if stopping == nil {
+			done := make(chan struct{})
+			close(done)
+			stopping = done
+		}
+		return stopping
+	}
+	done := make(chan struct{})
+	stopping = done
+	started := launched
+	go func() {
+		// Stopping an App that hasn't started yet dereferences nil
+		<-started
+		a.Stop(svcutil.ExitSuccess)
+		a.Wait()
+		if tmpDir != "" {
+			os.RemoveAll(tmpDir)
+		}
+		close(done)
+	}()
+	return done
+}
+
+// StopAsync starts stopping the engine like Stop but returns straight away,
+// telling done, if not nil, once shutdown has finished. A Start meanwhile
+// waits for the shutdown to finish before starting again.
+func StopAsync(done DoneHandler) {
+	mu.Lock()
+	ch := stopApp()
+	mu.Unlock()
+
+	go func() {
+		<-ch
+		if done != nil {
+			done.OnDone()
+		}
+	}()
+}
+
+// Flush makes the database write out everything it holds in memory. The
+// backend only offers this as a full compaction, which can take a few
+// seconds on a large database.
+func Flush() error {
+	mu.Lock()
+	b := ldb
+	mu.Unlock()
+	if b == nil {
+		return ErrNotRunning
+	}
+	return b.Compact()
+}
+
+type databaseIntegrity struct {
+	Consistent  bool              `json:"consistent"`
+	NeedsRepair bool              `json:"needsRepair"`
+	Folders     []folderIntegrity `json:"folders"`
+}
+
+type folderIntegrity struct {
+	Folder       string `json:"folder"`
+	State        string `json:"state"`
+	CountedItems int    `json:"countedItems"`
+	IndexedItems int    `json:"indexedItems"`
+	Consistent   bool   `json:"consistent"`
+}
+
+// CheckDatabaseIntegrity returns a JSON report on the database: whether
+// Syncthing flagged it for repair after hitting an inconsistency, and for
+// each idle folder whether the file and symlink counts kept in its metadata
+// match the entries actually in the global index. Busy folders are listed
+// but not checked, as their counts are moving. Returns "" when the engine
+// isn't reachable.
+func CheckDatabaseIntegrity() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	path := dbPath
+	var folderIDs []string
+	for _, f := range cfg.FolderList() {
+		folderIDs = append(folderIDs, f.ID)
+	}
+	mu.Unlock()
+	sort.Strings(folderIDs)
+
+	report := databaseIntegrity{Consistent: true, Folders: []folderIntegrity{}}
+	if _, err := os.Stat(path + ".needsrepair"); err == nil && path != "" {
+		report.NeedsRepair = true
+		report.Consistent = false
+	}
+
+	for _, folderID := range folderIDs {
+		var sum model.FolderSummary
+		if err := apiRequest(http.MethodGet, "/rest/db/status", url.Values{"folder": {folderID}}, nil, &sum); err != nil {
+			return ""
+		}
+		fi := folderIntegrity{
+			Folder:       folderID,
+			State:        sum.State,
+			CountedItems: sum.GlobalFiles + sum.GlobalSymlinks,
+			IndexedItems: -1,
+			Consistent:   true,
+		}
+		if sum.State == "idle" {
+			indexed, err := indexedFiles(folderID)
+			if err != nil {
+				return ""
+			}
+			fi.IndexedItems = len(indexed)
+			fi.Consistent = fi.IndexedItems == fi.CountedItems
+		}
+		if !fi.Consistent {
+			report.Consistent = false
+		}
+		report.Folders = append(report.Folders, fi)
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// RepairDatabase throws the database away so that it is rebuilt from the
+// folder contents, rescanning every folder and fetching the indexes from
+// peers again, as Syncthing's -reset-database does. A running engine is
+// stopped for this and started again, which can take a while on large
+// folders.
+func RepairDatabase() error {
+	mu.Lock()
+	dir := dataDir
+	wasRunning := running
+	if inMemory {
+		mu.Unlock()
+		return ErrInMemory
+	}
+	if dir == "" {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	stopped := stopApp()
+	path := filepath.Join(dir, "index-v0.14.0.db")
+	mu.Unlock()
+
+	// Wait without mu, then make sure nothing opened the database again
+	<-stopped
+	mu.Lock()
+	restarted := running
+	mu.Unlock()
+	if restarted {
+		return ErrRunning
+	}
+
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	os.Remove(path + ".needsrepair")
+	addEvent("Database reset for repair")
+
+	if wasRunning {
+		return Start(dir)
+	}
+	return nil
+}
+
+// ResetFolder drops the folder's index from the database, so the folder is
+// rescanned and its index fetched from peers again as if newly added, the
+// way Syncthing's folder reset does. That restarts the engine. Local files
+// that differ from the cluster can come back as conflicts, so callers
+// should have the user confirm this first.
+func ResetFolder(folderID string) error {
+	mu.Lock()
+	if cfg == nil || !running {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	if inMemory {
+		// The reset restarts the engine, which would lose everything
+		mu.Unlock()
+		return ErrInMemory
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		mu.Unlock()
+		return ErrUnknownFolder
+	}
+	wasPaused := fcfg.Paused
+	dir := dataDir
+	// Syncthing only resets paused folders
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				c.Folders[i].Paused = true
+			}
+		}
+	})
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+
+	if err := apiRequest(http.MethodPost, "/rest/system/reset", url.Values{"folder": {folderID}}, nil, nil); err != nil {
+		if !wasPaused {
+			mu.Lock()
+			if cfg != nil {
+				if _, err := cfg.Modify(unpauseFolder(folderID)); err != nil {
+					addEvent(fmt.Sprintf("Resuming %s after failed reset: %v", folderID, err))
+				}
+			}
+			mu.Unlock()
+		}
+		return err
+	}
+	addEvent(fmt.Sprintf("Reset folder %s", folderID))
+
+	// The reset makes the engine exit to be restarted. That shutdown isn't
+	// ours, so wait for it without mu.
+	mu.Lock()
+	stopped := stopApp()
+	mu.Unlock()
+	<-stopped
+
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	if !wasPaused {
+		_, err = cfg.Modify(unpauseFolder(folderID))
+		if err == nil {
+			// Start reloads from disk, so this can't wait for auto-save
+			err = cfg.(*configFile).write()
+		}
+	}
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return Start(dir)
+}
+
+// GetMemoryStats returns the Go heap and the database's memory budget and
+// on-disk size as JSON, in bytes.
+func GetMemoryStats() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	mu.Lock()
+	path, cache := dbPath, dbCache
+	mu.Unlock()
+
+	data, err := json.Marshal(map[string]interface{}{
+		"heapInUse":  ms.HeapInuse,
+		"heapSys":    ms.HeapSys,
+		"sys":        ms.Sys,
+		"numGC":      ms.NumGC,
+		"goroutines": runtime.NumGoroutine(),
+		"dbCache":    cache,
+		"dbDisk":     dirSize(path),
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// SetAutoSave chooses whether configuration changes are written to disk
+// on their own, a few seconds after each change, or held back until
+// SaveConfig, which saves flash wear during bulk changes. Stop saves
+// anything held back either way. Enabled by default; enabling it saves
+// pending changes right away.
+func SetAutoSave(enabled bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	autoSave = enabled
+	if f, ok := cfg.(*configFile); ok {
+		return f.setAutoSave(enabled)
+	}
+	return nil
+}
+
+// SaveConfig writes the configuration to disk now, even with auto-save off.
+func SaveConfig() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	f, ok := cfg.(*configFile)
+	if !ok {
+		return ErrNotRunning
+	}
+	return f.write()
+}
+
+// GetConfigPath returns the path of the config.xml in use, or "" before
+// Start.
+func GetConfigPath() string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ""
+	}
+	return cfg.ConfigPath()
+}
+
+// GetConfigVersion returns the schema version of the active configuration,
+// or 0 before Start.
+func GetConfigVersion() int {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return 0
+	}
+	return cfg.RawCopy().Version
+}
+
+// ConfigWasMigrated reports whether the configuration loaded by the last
+// Start was written by an older schema version and migrated on load.
+func ConfigWasMigrated() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return cfgLoadedVersion != 0 && cfgLoadedVersion != config.CurrentVersion
+}
+
+// HasUnsavedChanges reports whether the active configuration differs from
+// what was last written to disk. Syncthing batches saves a few seconds
+// after a change, so this is briefly true after every modification.
+// Changes that are never saved, like battery pauses, don't count.
+func HasUnsavedChanges() bool {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return false
+	}
+	current := cfg.RawCopy()
+	if f, ok := cfg.(*configFile); ok {
+		f.mut.Lock()
+		current = f.diskCopy()
+		f.mut.Unlock()
+	}
+	mu.Unlock()
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return !reflect.DeepEqual(current, savedCfg)
+}
+
+// GetEffectiveConfig returns the active configuration as JSON, with every
+// default Syncthing filled in. The GUI API key and password and folder
+// encryption passwords are redacted. The private key isn't part of the
+// configuration. Returns "" before Start.
+func GetEffectiveConfig() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	c := cfg.RawCopy()
+	mu.Unlock()
+
+	const redacted = "<redacted>"
+	if c.GUI.APIKey != "" {
+		c.GUI.APIKey = redacted
+	}
+	if c.GUI.Password != "" {
+		c.GUI.Password = redacted
+	}
+	for i := range c.Folders {
+		for j := range c.Folders[i].Devices {
+			if c.Folders[i].Devices[j].EncryptionPassword != "" {
+				c.Folders[i].Devices[j].EncryptionPassword = redacted
+			}
+		}
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func IsRunning() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return running
+}
+
+func GetDeviceID() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return myID.String()
+}
+
+type certificateInfo struct {
+	DeviceID    string    `json:"deviceID"`
+	Fingerprint string    `json:"fingerprint"`
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	SelfSigned  bool      `json:"selfSigned"`
+}
+
+// GetCertificateInfo returns the SHA-256 fingerprint, subject, issuer and
+// validity of the certificate our device ID derives from, as JSON. Returns
+// "" before Start.
+func GetCertificateInfo() string {
+	mu.Lock()
+	dir := dataDir
+	mu.Unlock()
+	if dir == "" {
+		return ""
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"))
+	if err != nil {
+		return ""
+	}
+	x, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(x.Raw)
+	data, err := json.Marshal(certificateInfo{
+		DeviceID:    protocol.NewDeviceID(x.Raw).String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Subject:     x.Subject.String(),
+		Issuer:      x.Issuer.String(),
+		NotBefore:   x.NotBefore,
+		NotAfter:    x.NotAfter,
+		SelfSigned:  x.CheckSignature(x.SignatureAlgorithm, x.RawTBSCertificate, x.Signature) == nil,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func SetFolder(folderID, folderPath string) error {
+	return setFolder(folderID, folderPath, false)
+}
+
+// AddFolderPaused adds the folder like SetFolder but paused, so nothing is
+// scanned or transferred until SetFolderPaused resumes it, e.g. once the
+// user has confirmed a large download. An existing folder only gets the new
+// path and keeps its pause state.
+func AddFolderPaused(folderID, folderPath string) error {
+	return setFolder(folderID, folderPath, true)
+}
+
+func setFolder(folderID, folderPath string, paused bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		addEvent("SetFolder: no config")
+		return nil
+	}
+
+	folderPath = strings.TrimSpace(folderPath)
+	switch filepath.Clean(folderPath) {
+	case ".", string(filepath.Separator):
+		return ErrInvalidFolderPath
+	}
+
+	for _, f := range cfg.FolderList() {
+		if f.ID != folderID && pathsOverlap(f.Path, folderPath) {
+			return ErrNestedFolderPath
+		}
+	}
+
+	addEvent(fmt.Sprintf("SetFolder: %s -> %s", folderID, folderPath))
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				c.Folders[i].Path = folderPath
+				return
+			}
+		}
+		c.Folders = append(c.Folders, config.FolderConfiguration{
+			ID:               folderID,
+			Path:             folderPath,
+			Type:             config.FolderTypeSendReceive,
+			FilesystemType:   folderFilesystem(),
+			RescanIntervalS:  10,
+			FSWatcherEnabled: !inMemory,
+			IgnorePerms:      runtime.GOOS == "ios",
+			Paused:           paused,
+		})
+	})
+	return err
+}
+
+// folderFilesystem is the filesystem new folders use. Called with mu held.
+func folderFilesystem() fs.FilesystemType {
+	if inMemory {
+		return fs.FilesystemTypeFake
+	}
+	return fs.FilesystemTypeBasic
+}
+
+// RemapFolderPaths rewrites folder paths starting with one of the mapping's
+// old prefixes to start with the new one instead, for when the app's
+// container moves between installs. The longest matching prefix wins.
+// Remapped folders restart, which rescans them.
+func RemapFolderPaths(mapping map[string]string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+
+	prefixes := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		prefixes[filepath.Clean(from)] = to
+	}
+	remap := func(path string) (string, bool) {
+		best := ""
+		for from := range prefixes {
+			if (path == from || strings.HasPrefix(path, from+string(filepath.Separator))) && len(from) > len(best) {
+				best = from
+			}
+		}
+		if best == "" {
+			return path, false
+		}
+		return filepath.Join(prefixes[best], strings.TrimPrefix(path, best)), true
+	}
+
+	changed := false
+	for _, f := range cfg.FolderList() {
+		if _, ok := remap(filepath.Clean(f.Path)); ok {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if path, ok := remap(filepath.Clean(c.Folders[i].Path)); ok {
+				addEvent(fmt.Sprintf("RemapFolderPaths: %s -> %s", c.Folders[i].ID, path))
+				c.Folders[i].Path = path
+			}
+		}
+	})
+	return err
+}
+
+// pathsOverlap reports whether a and b are the same directory or one
+// contains the other.
+func pathsOverlap(a, b string) bool {
+	clean := func(p string) string {
+		if expanded, err := fs.ExpandTilde(p); err == nil {
+			p = expanded
+		}
+		return filepath.Clean(p) + string(filepath.Separator)
+	}
+	a, b = clean(a), clean(b)
+	return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+}
+
+// modifyFolder applies fn to the configuration of an existing folder.
+// Must be called with mu held.
+func modifyFolder(folderID string, fn func(*config.FolderConfiguration)) error {
+	if cfg == nil {
+		return nil
+	}
+	if _, ok := cfg.Folder(folderID); !ok {
+		return ErrUnknownFolder
+	}
+
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				fn(&c.Folders[i])
+				return
+			}
+		}
+	})
+	return err
+}
+
+// SetFolderPaused pauses or resumes the folder.
+func SetFolderPaused(folderID string, paused bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.Paused = paused
+	})
+}
+
+// SetFolderSendOwnership controls whether file ownership is sent to peers
+// for the folder.
+func SetFolderSendOwnership(folderID string, send bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.SendOwnership = send
+	})
+}
+
+// SetFolderSyncXattrs controls whether extended attributes are both sent
+// and applied for the folder. Mostly useful for macOS peers; on iOS
+// applying them tends to fail with permission errors.
+func SetFolderSyncXattrs(folderID string, syncXattrs bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.SyncXattrs = syncXattrs
+		f.SendXattrs = syncXattrs
+	})
+}
+
+// SetHideTempFiles sets the hidden flag on the temp files Syncthing writes
+// while pulling into the folder, so Files.app doesn't list half-downloaded
+// files even with hidden files shown. Only Apple platforms have the flag.
+// Enabling it also hides temp files already there, which Syncthing keeps
+// to resume interrupted pulls; call it again after each Start.
+func SetHideTempFiles(folderID string, hide bool) error {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		mu.Unlock()
+		return ErrUnknownFolder
+	}
+	hideTempFolders[folderID] = hide
+	mu.Unlock()
+
+	if !hide {
+		return nil
+	}
+
+	ffs := fcfg.Filesystem(nil)
+	return ffs.Walk(".", func(path string, info fs.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && fs.IsTemporary(path) {
+			setHidden(filepath.Join(ffs.URI(), path))
+		}
+		return nil
+	})
+}
+
+// hideTempFile hides the temp file for item once the puller has created
+// it, giving up after a few seconds.
+func hideTempFile(folderID, item string) {
+	mu.Lock()
+	if !hideTempFolders[folderID] || cfg == nil {
+		mu.Unlock()
+		return
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	mu.Unlock()
+	if !ok {
+		return
+	}
+
+	path := filepath.Join(fcfg.Filesystem(nil).URI(), fs.TempName(item))
+	for i := 0; i < 50; i++ {
+		if setHidden(path) == nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// SetFolderWatcher turns the folder's filesystem watcher on or off. The
+// watcher is a stub on iOS, where this only changes what the config says.
+func SetFolderWatcher(folderID string, enabled bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.FSWatcherEnabled = enabled
+	})
+}
+
+// observerFolder is what SetFolderObserverMode restores when turned off,
+// plus the files fetched through RequestFile meanwhile. Kept in
+// observersFile, as the folder stays in observer mode across restarts.
+type observerFolder struct {
+	FolderType config.FolderType `json:"folderType"`
+	Ignores    []string          `json:"ignores"`
+	Fetched    []string          `json:"fetched,omitempty"`
+}
+
+// SetFolderObserverMode makes the folder receive-only and ignore everything,
+// so peers' files are indexed and browsable but nothing is downloaded until
+// asked for with RequestFile. Turning it off restores the folder type and
+// ignore patterns, after which everything still needed is pulled.
+func SetFolderObserverMode(folderID string, enabled bool) error {
+	if !folderExists(folderID) {
+		return ErrUnknownFolder
+	}
+
+	mu.Lock()
+	ob, on := observers[folderID]
+	mu.Unlock()
+	if enabled == on {
+		return nil
+	}
+
+	if !enabled {
+		mu.Lock()
+		err := modifyFolder(folderID, func(f *config.FolderConfiguration) {
+			f.Type = ob.FolderType
+		})
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := setIgnores(folderID, ob.Ignores); err != nil {
+			return err
+		}
+		mu.Lock()
+		delete(observers, folderID)
+		err = saveObservers()
+		mu.Unlock()
+		return err
+	}
+
+	var ignores struct {
+		Ignore []string `json:"ignore"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/db/ignores", url.Values{"folder": {folderID}}, nil, &ignores); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		mu.Unlock()
+		return ErrUnknownFolder
+	}
+	ob = &observerFolder{FolderType: fcfg.Type, Ignores: ignores.Ignore}
+	observers[folderID] = ob
+	// Saved first, so the originals survive even if we die halfway
+	if err := saveObservers(); err != nil {
+		delete(observers, folderID)
+		mu.Unlock()
+		return err
+	}
+	err := modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.Type = config.FolderTypeReceiveOnly
+	})
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return setIgnores(folderID, observerIgnores(ob))
+}
+
+// saveObservers writes observers to observersFile. Called with mu held.
+func saveObservers() error {
+	if inMemory {
+		return nil
+	}
+	data, err := json.Marshal(observers)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dataDir, observersFile), data)
+}
+
+// writeFileAtomic replaces path with data, so a crash leaves either the
+// old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	fd, err := osutil.CreateAtomic(path)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+// observerIgnores lets only the fetched files of an observed folder through.
+func observerIgnores(ob *observerFolder) []string {
+	lines := make([]string, 0, len(ob.Fetched)+1)
+	for _, name := range ob.Fetched {
+		lines = append(lines, "!/"+escapeIgnorePattern(name))
+	}
+	return append(lines, "*")
+}
+
+// SetFolderScanVerify trades thoroughness for speed when writing the
+// folder. Syncthing always checks pulled and copied blocks against their
+// hashes, so the levels only change the extra work around that:
+//
+//   - "full" is Syncthing's default: changed files are searched for
+//     shifted blocks to reuse, which reads the old file in full.
+//   - "minimal" skips the shifted block search, which is faster on slow
+//     flash but may transfer blocks that could have been reused.
+//
+// Neither level touches fsync, so written files stay as durable as ever.
+func SetFolderScanVerify(folderID string, level string) error {
+	var weakHashPct int
+	switch level {
+	case "full":
+		weakHashPct = 25
+	case "minimal":
+		// Above 100% changed blocks, so the weak hash search never runs.
+		weakHashPct = 101
+	default:
+		return fmt.Errorf("unknown verification level %q", level)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.WeakHashThresholdPct = weakHashPct
+	})
+}
+
+// SetFolderIgnorePerms controls whether permission changes are ignored in
+// the folder, both when scanning and when pulling. Folders created by
+// SetFolder on iOS start with this on.
+func SetFolderIgnorePerms(folderID string, ignore bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.IgnorePerms = ignore
+	})
+}
+
+// SetFolderConflictHandling sets how many conflict copies the folder keeps
+// per file: 0 disables them, so the losing side of a conflict is dropped,
+// and -1 keeps any number.
+func SetFolderConflictHandling(folderID string, keep int) error {
+	if keep < -1 {
+		return fmt.Errorf("conflict copies must be -1 or more, got %d", keep)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.MaxConflicts = keep
+	})
+}
+
+type scanLimit struct {
+	limit     time.Duration
+	rescanS   int    // the folder's own rescan interval, which the chunks take over
+	cursor    string // last top-level entry scanned
+	lastRound time.Time
+}
+
+// SetFolderScanTimeLimit bounds how long the folder's periodic scans run,
+// so a huge folder doesn't hold the CPU for minutes. Syncthing can't stop
+// a scan partway, so instead of its full rescans the folder is scanned one
+// top-level entry at a time, stopping once the limit has passed and
+// carrying on from there at the next rescan interval. A single large
+// directory can still take longer, and the scan when the folder starts is
+// always a full one. 0 restores normal scanning.
+func SetFolderScanTimeLimit(folderID string, seconds int) error {
+	if seconds < 0 {
+		return fmt.Errorf("scan time limit must not be negative, got %d", seconds)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		return ErrUnknownFolder
+	}
+
+	cf, _ := cfg.(*configFile)
+	sl, limited := scanLimits[folderID]
+	switch {
+	case seconds == 0 && !limited:
+		return nil
+	case seconds == 0:
+		delete(scanLimits, folderID)
+		if cf != nil {
+			cf.setRuntimeOnly("scanLimit "+folderID, nil)
+		}
+		return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+			f.RescanIntervalS = sl.rescanS
+		})
+	case limited:
+		sl.limit = time.Duration(seconds) * time.Second
+		return nil
+	}
+	scanLimits[folderID] = &scanLimit{
+		limit:     time.Duration(seconds) * time.Second,
+		rescanS:   fcfg.RescanIntervalS,
+		lastRound: time.Now(),
+	}
+	if cf != nil {
+		cf.setRuntimeOnly("scanLimit "+folderID, restoreRescanInterval(folderID, fcfg.RescanIntervalS))
+	}
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.RescanIntervalS = 0
+	})
+}
+
+// applyScanLimits turns off Syncthing's own rescans for folders under a
+// scan time limit in a freshly loaded config. The config on disk keeps
+// their interval, so they scan normally after a crash. Called with mu held.
+func applyScanLimits() error {
+	if cfg == nil || len(scanLimits) == 0 {
+		return nil
+	}
+	if f, ok := cfg.(*configFile); ok {
+		for folderID, sl := range scanLimits {
+			f.setRuntimeOnly("scanLimit "+folderID, restoreRescanInterval(folderID, sl.rescanS))
+		}
+	}
+
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if _, ok := scanLimits[c.Folders[i].ID]; ok {
+				c.Folders[i].RescanIntervalS = 0
+			}
+		}
+	})
+	return err
+}
+
+func restoreRescanInterval(folderID string, rescanS int) func(*config.Configuration) {
+	return func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				c.Folders[i].RescanIntervalS = rescanS
+			}
+		}
+	}
+}
+
+// watchScanLimits runs the chunked scans of SetFolderScanTimeLimit.
+func watchScanLimits() {
+	for {
+		time.Sleep(time.Second)
+
+		mu.Lock()
+		if !running {
+			mu.Unlock()
+			return
+		}
+		var due []string
+		for folderID, sl := range scanLimits {
+			if sl.rescanS > 0 && time.Since(sl.lastRound) >= time.Duration(sl.rescanS)*time.Second {
+				due = append(due, folderID)
+			}
+		}
+		mu.Unlock()
+
+		for _, folderID := range due {
+			scanChunk(folderID)
+		}
+	}
+}
+
+// scanChunk scans the folder's top-level entries after the last one
+// scanned, in name order and wrapping around, until the time limit passes
+// or every entry has been scanned once.
+func scanChunk(folderID string) {
+	mu.Lock()
+	sl, ok := scanLimits[folderID]
+	fcfg, exists := cfg.Folder(folderID)
+	if !ok || !exists {
+		mu.Unlock()
+		return
+	}
+	limit, cursor := sl.limit, sl.cursor
+	mu.Unlock()
+
+	// What's on disk plus what's indexed, so deletions are picked up
+	seen := make(map[string]bool)
+	if names, err := fcfg.Filesystem(nil).DirNames("."); err == nil {
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+	var tree []*model.TreeEntry
+	if err := apiRequest(http.MethodGet, "/rest/db/browse", url.Values{
+		"folder": {folderID},
+		"levels": {"0"},
+	}, nil, &tree); err == nil {
+		for _, e := range tree {
+			seen[e.Name] = true
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start := sort.SearchStrings(names, cursor)
+	if start < len(names) && names[start] == cursor {
+		start++
+	}
+	deadline := time.Now().Add(limit)
+	failed := 0
+	for i := 0; i < len(names) && time.Now().Before(deadline); i++ {
+		name := names[(start+i)%len(names)]
+		// A timeout only means the entry takes longer than the client
+		// waits; Syncthing carries on scanning it
+		err := apiRequest(http.MethodPost, "/rest/db/scan", url.Values{
+			"folder": {folderID},
+			"sub":    {name},
+		}, nil, nil)
+		if err != nil && !os.IsTimeout(err) {
+			if failed == 0 {
+				addEvent(fmt.Sprintf("Chunked scan of %s/%s failed: %v", folderID, name, err))
+			}
+			failed++
+		}
+		// Failed entries are skipped too, so one bad entry can't hold
+		// back the rest
+		cursor = name
+	}
+	if failed > 1 {
+		addEvent(fmt.Sprintf("Chunked scan of %s: %d entries failed", folderID, failed))
+	}
+
+	mu.Lock()
+	if sl, ok := scanLimits[folderID]; ok {
+		sl.cursor = cursor
+		sl.lastRound = time.Now()
+	}
+	mu.Unlock()
+}
+
+// SetFolderCopiers sets the number of copier routines for the folder; 0
+// lets syncthing pick. Takes effect when the folder restarts, which a
+// config change triggers.
+func SetFolderCopiers(folderID string, copiers int) error {
+	if copiers < 0 {
+		return fmt.Errorf("copiers must not be negative, got %d", copiers)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.Copiers = copiers
+	})
+}
+
+// SetFolderHashers sets the number of hasher routines for the folder; 0
+// lets syncthing pick.
+func SetFolderHashers(folderID string, hashers int) error {
+	if hashers < 0 {
+		return fmt.Errorf("hashers must not be negative, got %d", hashers)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.Hashers = hashers
+	})
+}
+
+// modifyOptions applies fn to the global options. Must be called with mu
+// held.
+func modifyOptions(fn func(*config.OptionsConfiguration)) error {
+	if cfg == nil {
+		return nil
+	}
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		fn(&c.Options)
+	})
+	return err
+}
+
+// SetGlobalDiscoveryServers replaces the global discovery server list. Each
+// entry is either one of the "default", "default-v4" or "default-v6" tokens
+// or an https:// URL. Only used while global discovery is enabled.
+func SetGlobalDiscoveryServers(servers []string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var cleaned []string
+	for _, srv := range servers {
+		srv = strings.TrimSpace(srv)
+		switch srv {
+		case "":
+			continue
+		case "default", "default-v4", "default-v6":
+		default:
+			u, err := url.Parse(srv)
+			if err != nil {
+				return fmt.Errorf("discovery server %q: %w", srv, err)
+			}
+			if u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("discovery server %q: must be an https:// URL", srv)
+			}
+		}
+		cleaned = append(cleaned, srv)
+	}
+	if len(cleaned) == 0 {
+		return ErrNoServers
+	}
+
+	return modifyOptions(func(o *config.OptionsConfiguration) {
+		o.RawGlobalAnnServers = cleaned
+	})
+}
+
+// SetLocalAnnounceInterval sets how often, in seconds, this device is
+// announced on the LAN, between 1 second and an hour. Syncthing broadcasts
+// every 30 seconds on its own, so shorter intervals add announcements in
+// between and 30 goes back to the default. For longer ones Syncthing's
+// local discovery is switched off, without saving that, and the
+// announcements sent from here instead; peers still find us and dial in,
+// but we no longer hear theirs. Peers forget an announcement after 90
+// seconds, so past that they can only find us right after one.
+func SetLocalAnnounceInterval(seconds int) error {
+	const limit = 3600
+	if seconds < 1 || seconds > limit {
+		return fmt.Errorf("local announce interval must be between 1 and %d, got %d", limit, seconds)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !running {
+		return ErrNotRunning
+	}
+	interval := time.Duration(seconds) * time.Second
+	if interval == discover.BroadcastInterval {
+		interval = 0
+	}
+
+	own := interval > discover.BroadcastInterval
+	if own != localAnnounceOwned && (localAnnounceOwned || cfg.Options().LocalAnnEnabled) {
+		if err := modifyOptions(func(o *config.OptionsConfiguration) {
+			o.LocalAnnEnabled = !own
+		}); err != nil {
+			return err
+		}
+		if f, ok := cfg.(*configFile); ok {
+			var undo func(*config.Configuration)
+			if own {
+				undo = func(c *config.Configuration) { c.Options.LocalAnnEnabled = true }
+			}
+			f.setRuntimeOnly("localAnnounce", undo)
+		}
+		localAnnounceOwned = own
+	}
+
+	// A new loop, so a change doesn't wait out the old interval
+	if localAnnounceStop != nil {
+		close(localAnnounceStop)
+		localAnnounceStop = nil
+	}
+	localAnnounceInterval = interval
+	if interval != 0 {
+		localAnnounceStop = make(chan struct{})
+		go announceLocally(quit, localAnnounceStop)
+	}
+	return nil
+}
+
+// announceLocally sends local discovery announcements every
+// localAnnounceInterval until either the engine stops or they are turned
+// off.
+func announceLocally(engine, stop <-chan struct{}) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		addEvent(fmt.Sprintf("Local announce: %v", err))
+		return
+	}
+	defer conn.Close()
+
+	instanceID := rand.Int63()
+	for {
+		mu.Lock()
+		interval := localAnnounceInterval
+		var opts config.OptionsConfiguration
+		if cfg != nil {
+			opts = cfg.Options()
+		}
+		enabled := opts.LocalAnnEnabled || localAnnounceOwned
+		id := myID
+		mu.Unlock()
+
+		select {
+		case <-engine:
+			return
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		if !enabled {
+			continue
+		}
+		pkt, ok := announcementPacket(id, instanceID)
+		if !ok {
+			continue
+		}
+		dsts := []string{net.JoinHostPort(net.IPv4bcast.String(), strconv.Itoa(opts.LocalAnnPort))}
+		if opts.LocalAnnMCAddr != "" {
+			dsts = append(dsts, opts.LocalAnnMCAddr)
+		}
+		for _, dst := range dsts {
+			if addr, err := net.ResolveUDPAddr("udp", dst); err == nil {
+				conn.WriteTo(pkt, addr)
+			}
+		}
+	}
+}
+
+// announcementPacket builds a local discovery packet for the dialable
+// listen addresses. Returns false if there is nothing to announce.
+func announcementPacket(id protocol.DeviceID, instanceID int64) ([]byte, bool) {
+	var status struct {
+		Listeners map[string]connections.ListenerStatusEntry `json:"connectionServiceStatus"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/status", nil, nil, &status); err != nil {
+		return nil, false
+	}
+
+	seen := make(map[string]bool)
+	var addrs []string
+	for _, ls := range status.Listeners {
+		for _, addr := range append(ls.LANAddresses, ls.WANAddresses...) {
+			u, err := url.Parse(addr)
+			if err != nil || u.Scheme == "relay" || seen[addr] {
+				continue
+			}
+			tcpAddr, err := net.ResolveTCPAddr("tcp", u.Host)
+			if err != nil || len(tcpAddr.IP) == 0 || tcpAddr.Port == 0 {
+				continue
+			}
+			if !tcpAddr.IP.IsGlobalUnicast() && !tcpAddr.IP.IsLinkLocalUnicast() && !tcpAddr.IP.IsUnspecified() {
+				continue
+			}
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, false
+	}
+
+	ann := discover.Announce{ID: id, Addresses: addrs, InstanceID: instanceID}
+	bs, err := ann.Marshal()
+	if err != nil {
+		return nil, false
+	}
+	pkt := make([]byte, 4, 4+len(bs))
+	binary.BigEndian.PutUint32(pkt, discover.Magic)
+	return append(pkt, bs...), true
+}
+
+// SetProgressUpdateInterval sets how often download progress events fire,
+// in seconds; -1 disables them. Takes effect immediately.
+func SetProgressUpdateInterval(seconds int) error {
+	if seconds != -1 && seconds < 1 {
+		return fmt.Errorf("progress update interval must be -1 or at least 1, got %d", seconds)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyOptions(func(o *config.OptionsConfiguration) {
+		o.ProgressUpdateIntervalS = seconds
+	})
+}
+
+// SetRelaysEnabled toggles relay connections. Relays are only used for
+// listening and dialing when this is on.
+func SetRelaysEnabled(enabled bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	return modifyOptions(func(o *config.OptionsConfiguration) {
+		o.RelaysEnabled = enabled
+	})
+}
+
+// SetRelayServers replaces the relays in the listen addresses, including
+// the community pool, with the given relay:// URIs.
+func SetRelayServers(uris []string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var relays []string
+	for _, uri := range uris {
+		uri = strings.TrimSpace(uri)
+		if uri == "" {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return fmt.Errorf("relay %q: %w", uri, err)
+		}
+		if u.Scheme != "relay" || u.Host == "" {
+			return fmt.Errorf("relay %q: must be a relay:// URI", uri)
+		}
+		relays = append(relays, uri)
+	}
+	if len(relays) == 0 {
+		return ErrNoServers
+	}
+
+	return modifyOptions(func(o *config.OptionsConfiguration) {
+		var addrs []string
+		for _, addr := range o.RawListenAddresses {
+			if addr == "default" {
+				addrs = append(addrs, config.DefaultListenAddresses...)
+			} else {
+				addrs = append(addrs, addr)
+			}
+		}
+		kept := addrs[:0]
+		for _, addr := range addrs {
+			if !strings.HasPrefix(addr, "relay://") && !strings.HasPrefix(addr, "dynamic+") {
+				kept = append(kept, addr)
+			}
+		}
+		o.RawListenAddresses = append(kept, relays...)
+	})
+}
+
+// SyncOnce resumes a paused folder and pauses it again once it has scanned
+// and reached idle with nothing left to pull. Folders that aren't paused
+// are left alone. If the engine stops first, the folder stays unpaused.
+func SyncOnce(folderID string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil || evLogger == nil || quit == nil {
+		return nil
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		return ErrUnknownFolder
+	}
+	if !fcfg.Paused {
+		return nil
+	}
+
+	// Subscribe before resuming so the first scan isn't missed
+	sub := evLogger.Subscribe(events.StateChanged | events.FolderSummary)
+	if err := modifyFolder(folderID, func(f *config.FolderConfiguration) {
+		f.Paused = false
+	}); err != nil {
+		sub.Unsubscribe()
+		return err
+	}
+	addEvent(fmt.Sprintf("SyncOnce: %s resumed", folderID))
+
+	// Stop waiting along with the engine, so the wait can't outlive it and
+	// pause the folder under the next one
+	stop := quit
+	go func() {
+		defer sub.Unsubscribe()
+
+		scanned := false
+		for {
+			var ev events.Event
+			select {
+			case <-stop:
+				return
+			case e, ok := <-sub.C():
+				if !ok {
+					return
+				}
+				ev = e
+			}
+
+			switch ev.Type {
+			case events.StateChanged:
+				data, ok := ev.Data.(map[string]interface{})
+				if ok && data["folder"] == folderID && (data["to"] == "scanning" || data["to"] == "syncing") {
+					scanned = true
+				}
+			case events.FolderSummary:
+				data, ok := ev.Data.(model.FolderSummaryEventData)
+				if !ok || data.Folder != folderID || data.Summary == nil {
+					continue
+				}
+				if scanned && data.Summary.State == "idle" && data.Summary.NeedTotalItems == 0 {
+					mu.Lock()
+					err := modifyFolder(folderID, func(f *config.FolderConfiguration) {
+						f.Paused = true
+					})
+					mu.Unlock()
+					if err != nil {
+						addEvent(fmt.Sprintf("SyncOnce: %s pause failed: %v", folderID, err))
+					} else {
+						addEvent(fmt.Sprintf("SyncOnce: %s synced, paused", folderID))
+					}
+					return
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func AddDevice(deviceID, name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return nil
+	}
+
+	if strictDeviceIDs {
+		if err := ValidateDeviceID(deviceID); err != nil {
+			return err
+		}
+	}
+
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		if reason := ValidateDeviceID(deviceID); reason != nil {
+			return reason
+		}
+		return err
+	}
+
+	_, err = cfg.Modify(func(c *config.Configuration) {
+		for _, d := range c.Devices {
+			if d.DeviceID == id {
+				return
+			}
+		}
+		c.Devices = append(c.Devices, config.DeviceConfiguration{
+			DeviceID: id,
+			Name:     name,
+		})
+	})
+	return err
+}
+
+type deviceEntry struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Addresses  []string `json:"addresses"`
+	Introducer bool     `json:"introducer"`
+}
+
+// AddDevices adds the devices in a JSON array of {id, name, addresses,
+// introducer} objects in a single config change, updating any that are
+// already configured. Addresses default to "dynamic", and an empty name
+// keeps a configured device's current name. If any entry is invalid
+// nothing is changed and the error names every entry that failed.
+func AddDevices(devicesJSON string) error {
+	var entries []deviceEntry
+	if err := json.Unmarshal([]byte(devicesJSON), &entries); err != nil {
+		return fmt.Errorf("parse devices: %w", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+
+	devices := make([]config.DeviceConfiguration, 0, len(entries))
+	var failed []error
+	for i, e := range entries {
+		fail := func(err error) {
+			failed = append(failed, fmt.Errorf("entry %d (%q): %w", i, e.ID, err))
+		}
+		if strictDeviceIDs {
+			if err := ValidateDeviceID(e.ID); err != nil {
+				fail(err)
+				continue
+			}
+		}
+		id, err := protocol.DeviceIDFromString(e.ID)
+		if err != nil {
+			if reason := ValidateDeviceID(e.ID); reason != nil {
+				err = reason
+			}
+			fail(err)
+			continue
+		}
+		if id == myID {
+			fail(errors.New("this is our own device ID"))
+			continue
+		}
+
+		var addrs []string
+		badAddr := false
+		for _, addr := range e.Addresses {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			if addr != "dynamic" {
+				if u, err := url.Parse(addr); err != nil || u.Scheme == "" || u.Host == "" {
+					fail(fmt.Errorf("invalid address %q", addr))
+					badAddr = true
+					break
+				}
+			}
+			addrs = append(addrs, addr)
+		}
+		if badAddr {
+			continue
+		}
+		if len(addrs) == 0 {
+			addrs = []string{"dynamic"}
+		}
+
+		devices = append(devices, config.DeviceConfiguration{
+			DeviceID:   id,
+			Name:       e.Name,
+			Addresses:  addrs,
+			Introducer: e.Introducer,
+		})
+	}
+	if len(failed) > 0 {
+		return errors.Join(failed...)
+	}
+	if len(devices) == 0 {
+		return nil
+	}
+
+	_, err := cfg.Modify(func(c *config.Configuration) {
+	next:
+		for _, dev := range devices {
+			for i := range c.Devices {
+				if c.Devices[i].DeviceID == dev.DeviceID {
+					if dev.Name != "" {
+						c.Devices[i].Name = dev.Name
+					}
+					c.Devices[i].Addresses = dev.Addresses
+					c.Devices[i].Introducer = dev.Introducer
+					continue next
+				}
+			}
+			c.Devices = append(c.Devices, dev)
+		}
+	})
+	return err
+}
+
+// SetDeviceDefaultFolderPath makes folders auto-accepted from the device
+// land under basePath instead of the default folder path. Syncthing only
+// has the one default, so folders it accepts from the device are moved
+// there before they start; whether they are accepted at all is still up
+// to the device's auto-accept setting. A folder whose directory would clash
+// with one already under basePath stays at the default path. An empty
+// basePath goes back to the default path. The setting isn't persisted and
+// has to be made again after Start.
+func SetDeviceDefaultFolderPath(deviceID, basePath string) error {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return err
+	}
+	if basePath != "" && !filepath.IsAbs(basePath) {
+		return fmt.Errorf("base path %q is not absolute", basePath)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+	if _, ok := cfg.Device(id); !ok {
+		return ErrUnknownDevice
+	}
+	if f, ok := cfg.(*configFile); ok {
+		if basePath != "" {
+			basePath = filepath.Clean(basePath)
+		}
+		f.setAcceptPath(id, basePath)
+	}
+	return nil
+}
+
+// RemoveIntroducedDevices removes every device the introducer added, and
+// unshares all folders with them, leaving the introducer itself in place.
+func RemoveIntroducedDevices(introducerID string) error {
+	id, err := protocol.DeviceIDFromString(introducerID)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+
+	_, err = cfg.Modify(func(c *config.Configuration) {
+		removed := make(map[protocol.DeviceID]bool)
+		devices := c.Devices[:0]
+		for _, d := range c.Devices {
+			if d.IntroducedBy == id {
+				removed[d.DeviceID] = true
+				continue
+			}
+			devices = append(devices, d)
+		}
+		c.Devices = devices
+		if len(removed) == 0 {
+			return
+		}
+		for i := range c.Folders {
+			shared := c.Folders[i].Devices[:0]
+			for _, fd := range c.Folders[i].Devices {
+				if !removed[fd.DeviceID] {
+					shared = append(shared, fd)
+				}
+			}
+			c.Folders[i].Devices = shared
+		}
+	})
+	return err
+}
+
+// SetFolderNoAutoShareDevices keeps introducers from sharing the folder
+// with the given devices. Syncthing has no such setting, so a share an
+// introducer adds for one of them is removed again straight after, and
+// existing introduced shares are removed now. Sharing the folder with them
+// directly still works. An empty list lifts the restriction.
+func SetFolderNoAutoShareDevices(folderID string, deviceIDs []string) error {
+	blocked := make(map[protocol.DeviceID]bool, len(deviceIDs))
+	for _, s := range deviceIDs {
+		id, err := protocol.DeviceIDFromString(s)
+		if err != nil {
+			return err
+		}
+		blocked[id] = true
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg != nil {
+		if _, ok := cfg.Folder(folderID); !ok {
+			return ErrUnknownFolder
+		}
+	}
+	if len(blocked) == 0 {
+		delete(noAutoShare, folderID)
+		return nil
+	}
+	noAutoShare[folderID] = blocked
+	return removeBlockedShares()
+}
+
+// removeBlockedShares drops introduced folder shares that
+// SetFolderNoAutoShareDevices forbids. Called with mu held.
+func removeBlockedShares() error {
+	if cfg == nil || len(noAutoShare) == 0 {
+		return nil
+	}
+
+	// Every Modify is committed to all subscribers, shareGuard included,
+	// so only modify when there is something to remove.
+	filtered := make(map[string][]config.FolderDeviceConfiguration)
+	for folderID, fcfg := range cfg.Folders() {
+		blocked := noAutoShare[folderID]
+		if blocked == nil {
+			continue
+		}
+		var shared []config.FolderDeviceConfiguration
+		for _, fd := range fcfg.Devices {
+			if blocked[fd.DeviceID] && fd.IntroducedBy != protocol.EmptyDeviceID {
+				continue
+			}
+			shared = append(shared, fd)
+		}
+		if len(shared) != len(fcfg.Devices) {
+			filtered[folderID] = shared
+		}
+	}
+	if len(filtered) == 0 {
+		return nil
+	}
+
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if shared, ok := filtered[c.Folders[i].ID]; ok {
+				c.Folders[i].Devices = shared
+			}
+		}
+	})
+	return err
+}
+
+// shareGuard runs removeBlockedShares after config changes that add
+// introduced shares.
+type shareGuard struct{}
+
+func (shareGuard) CommitConfiguration(from, to config.Configuration) bool {
+	before := make(map[string]map[protocol.DeviceID]bool, len(from.Folders))
+	for _, f := range from.Folders {
+		ids := make(map[protocol.DeviceID]bool, len(f.Devices))
+		for _, fd := range f.Devices {
+			ids[fd.DeviceID] = true
+		}
+		before[f.ID] = ids
+	}
+
+	added := make(map[string][]protocol.DeviceID)
+	for _, f := range to.Folders {
+		for _, fd := range f.Devices {
+			if fd.IntroducedBy != protocol.EmptyDeviceID && !before[f.ID][fd.DeviceID] {
+				added[f.ID] = append(added[f.ID], fd.DeviceID)
+			}
+		}
+	}
+	if len(added) == 0 {
+		return true
+	}
+
+	// Whoever made the change may be waiting on us with mu held
+	go func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for folderID, ids := range added {
+			for _, id := range ids {
+				if noAutoShare[folderID][id] {
+					if err := removeBlockedShares(); err != nil {
+						addEvent(fmt.Sprintf("Removing blocked shares failed: %v", err))
+					}
+					return
+				}
+			}
+		}
+	}()
+	return true
+}
+
+func (shareGuard) String() string {
+	return "shareGuard"
+}
+
+// SetStrictDeviceIDs makes AddDevice apply the same checks as
+// ValidateDeviceID instead of accepting anything Syncthing can parse.
+func SetStrictDeviceIDs(strict bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	strictDeviceIDs = strict
+}
+
+// ValidateDeviceID checks a hand-typed device ID. Unlike
+// DeviceIDFromString it rejects empty IDs and old-style IDs without check
+// digits, and reports a failed luhn check as ErrDeviceIDChecksum.
+func ValidateDeviceID(deviceID string) error {
+	s := strings.ToUpper(strings.TrimSpace(deviceID))
+	s = strings.NewReplacer("-", "", " ", "").Replace(strings.Trim(s, "="))
+
+	switch len(s) {
+	case 0:
+		return ErrDeviceIDEmpty
+	case 52:
+		return ErrDeviceIDNoCheckDigits
+	case 56:
+	default:
+		return ErrDeviceIDLength
+	}
+	// Base32, plus the 0, 1 and 8 that Syncthing reads as O, I and B
+	if strings.Trim(s, "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567018") != "" {
+		return ErrDeviceIDCharacters
+	}
+
+	if _, err := protocol.DeviceIDFromString(s); err != nil {
+		// Drop the check digit after each 13-character group; if the rest
+		// parses, the only thing wrong is the checksum.
+		var b strings.Builder
+		for i := 0; i < 4; i++ {
+			b.WriteString(s[i*14 : i*14+13])
+		}
+		if _, plainErr := protocol.DeviceIDFromString(b.String()); plainErr == nil {
+			return ErrDeviceIDChecksum
+		}
+		return err
+	}
+	return nil
+}
+
+// ParseDeviceIDWithReason checks a hand-typed device ID like
+// ValidateDeviceID and returns it in canonical form.
+func ParseDeviceIDWithReason(s string) (string, error) {
+	if err := ValidateDeviceID(s); err != nil {
+		return "", err
+	}
+	id, err := protocol.DeviceIDFromString(strings.TrimSpace(s))
+	if err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
+
+func ShareFolderWithDevice(folderID, deviceID string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return nil
+	}
+
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID != folderID {
+				continue
+			}
+			for _, d := range c.Folders[i].Devices {
+				if d.DeviceID == id {
+					return
+				}
+			}
+			c.Folders[i].Devices = append(c.Folders[i].Devices, config.FolderDeviceConfiguration{
+				DeviceID: id,
+			})
+			return
+		}
+	})
+	return err
+}
+
+// PairAndShare adds a device, shares folderID with it and trusts it by
+// dropping it from the ignored devices, all in one config change that is
+// saved straight away. Nothing is changed if the device ID or folder is
+// invalid.
+func PairAndShare(deviceID, name, folderID string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+
+	if strictDeviceIDs {
+		if err := ValidateDeviceID(deviceID); err != nil {
+			return err
+		}
+	}
+
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		if reason := ValidateDeviceID(deviceID); reason != nil {
+			return reason
+		}
+		return err
+	}
+	if _, ok := cfg.Folder(folderID); !ok {
+		return ErrUnknownFolder
+	}
+
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		known := false
+		for i := range c.Devices {
+			if c.Devices[i].DeviceID == id {
+				if name != "" {
+					c.Devices[i].Name = name
+				}
+				known = true
+			}
+		}
+		if !known {
+			c.Devices = append(c.Devices, config.DeviceConfiguration{
+				DeviceID: id,
+				Name:     name,
+			})
+		}
+
+		var ignored []config.ObservedDevice
+		for _, d := range c.IgnoredDevices {
+			if d.ID != id {
+				ignored = append(ignored, d)
+			}
+		}
+		c.IgnoredDevices = ignored
+
+		for i := range c.Folders {
+			if c.Folders[i].ID != folderID {
+				continue
+			}
+			if _, ok := c.Folders[i].Device(id); !ok {
+				c.Folders[i].Devices = append(c.Folders[i].Devices, config.FolderDeviceConfiguration{
+					DeviceID: id,
+				})
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+	// Save only marks the config dirty while auto-save is off
+	return cfg.(*configFile).write()
+}
+
+// reconnectDevice drops the connection to a device by pausing and resuming
+// it, after which Syncthing redials it. Devices the user paused are left
+// alone. Must be called with mu held.
+func reconnectDevice(id protocol.DeviceID) error {
+	if cfg == nil {
+		return nil
+	}
+	if dev, ok := cfg.Device(id); !ok || dev.Paused {
+		return nil
+	}
+
+	for _, paused := range []bool{true, false} {
+		waiter, err := cfg.Modify(func(c *config.Configuration) {
+			for i := range c.Devices {
+				if c.Devices[i].DeviceID == id {
+					c.Devices[i].Paused = paused
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+		waiter.Wait()
+	}
+	return nil
+}
+
+// DisconnectDevice drops the current connection to the device, which also
+// stops any transfer in progress. The device stays configured and unpaused,
+// so Syncthing dials it again shortly after. Does nothing if the device
+// isn't connected.
+func DisconnectDevice(deviceID string) error {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return err
+	}
+	conns, err := getConnections()
+	if err != nil {
+		return err
+	}
+	if !conns[id].Connected {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+	if _, ok := cfg.Device(id); !ok {
+		return ErrUnknownDevice
+	}
+	addEvent(fmt.Sprintf("Disconnecting %s", id.Short()))
+	return reconnectDevice(id)
+}
+
+// NotifyNetworkChanged restarts the listeners and redials every unpaused
+// peer right away, dropping connections that may have died with the old
+// network. Syncthing has no network-change hook of its own, so this cycles
+// the listen addresses and device pause state through config, which its
+// connection service reacts to immediately.
+func NotifyNetworkChanged() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil || !running {
+		return nil
+	}
+
+	before := cfg.RawCopy()
+	var cycled []protocol.DeviceID
+	for _, dev := range before.Devices {
+		if dev.DeviceID != myID && !dev.Paused {
+			cycled = append(cycled, dev.DeviceID)
+		}
+	}
+	setDevicesPaused := func(c *config.Configuration, paused bool) {
+		for i := range c.Devices {
+			for _, id := range cycled {
+				if c.Devices[i].DeviceID == id {
+					c.Devices[i].Paused = paused
+				}
+			}
+		}
+	}
+
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		c.Options.RawListenAddresses = []string{}
+		setDevicesPaused(c, true)
+	})
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+
+	waiter, err = cfg.Modify(func(c *config.Configuration) {
+		c.Options.RawListenAddresses = before.Options.RawListenAddresses
+		setDevicesPaused(c, false)
+	})
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+
+	addEvent(fmt.Sprintf("Network changed, redialing %d devices", len(cycled)))
+	return nil
+}
+
+// SetScanOnBattery chooses whether folders keep scanning and syncing while
+// the battery is low and not charging, as last reported to
+// NotifyBatteryLevel. When disabled, such a low battery pauses every
+// running folder until it charges or recovers. Enabled by default.
+func SetScanOnBattery(enabled bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	scanOnBattery = enabled
+	return applyBatteryPolicy()
+}
+
+// NotifyBatteryLevel tells the engine the current battery state, for
+// SetScanOnBattery. Call it whenever the platform reports a change.
+func NotifyBatteryLevel(percent int, charging bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	batteryLow = !charging && percent <= lowBatteryPercent
+	if err := applyBatteryPolicy(); err != nil {
+		addEvent(fmt.Sprintf("Battery policy failed: %v", err))
+	}
+}
+
+// applyBatteryPolicy pauses or resumes folders for the battery state. Only
+// folders it paused itself are resumed. The pauses aren't saved, so folders
+// still run after the app is killed on a low battery. Called with mu held.
+func applyBatteryPolicy() error {
+	if cfg == nil {
+		return nil
+	}
+	f, _ := cfg.(*configFile)
+
+	pause := batteryLow && !scanOnBattery
+	changed := 0
+	_, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			fc := &c.Folders[i]
+			switch {
+			case pause && !fc.Paused:
+				fc.Paused = true
+				batteryPaused[fc.ID] = true
+				if f != nil {
+					f.setRuntimeOnly("battery "+fc.ID, unpauseFolder(fc.ID))
+				}
+				changed++
+			case !pause && batteryPaused[fc.ID] && fc.Paused:
+				fc.Paused = false
+				changed++
+			}
+		}
+		if !pause {
+			if f != nil {
+				for id := range batteryPaused {
+					f.setRuntimeOnly("battery "+id, nil)
+				}
+			}
+			batteryPaused = make(map[string]bool)
+		}
+	})
+	if err != nil || changed == 0 {
+		return err
+	}
+	if pause {
+		addEvent(fmt.Sprintf("Battery low, paused %d folders", changed))
+	} else {
+		addEvent(fmt.Sprintf("Battery recovered, resumed %d folders", changed))
+	}
+	return nil
+}
+
+func unpauseFolder(folderID string) func(*config.Configuration) {
+	return func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				c.Folders[i].Paused = false
+			}
+		}
+	}
+}
+
+// SetKeepAliveInterval redials peers whose connection hasn't received any
+// data for the given number of seconds. Syncthing's pings arrive up to 90s
+// apart on a healthy idle connection, so the interval must be at least
+// twice that. How often disconnected peers are redialed is up to
+// SetReconnectBackoff.
+func SetKeepAliveInterval(seconds int) error {
+	if least := int(2 * protocol.PingSendInterval / time.Second); seconds < least {
+		return fmt.Errorf("keep-alive interval must be at least %ds, got %d", least, seconds)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Otherwise the next Start begins watching
+	if keepAliveInterval == 0 && quit != nil {
+		go watchConnections(quit)
+	}
+	keepAliveInterval = time.Duration(seconds) * time.Second
+	return nil
+}
+
+// SetReconnectBackoff makes redialing back off while peers stay
+// unreachable, so waking up with many offline peers doesn't keep dialing
+// all of them at a fixed rate. Syncthing uses one redial interval for every
+// device, so the backoff is shared: it starts at minSeconds, doubles each
+// time the interval passes with a configured device still disconnected, up
+// to maxSeconds, and drops back to minSeconds when a device connects.
+// Syncthing won't redial more often than every 5 seconds, so minSeconds
+// must be at least that. Nothing else here changes the reconnect interval.
+// The backed-off interval is never saved; passing 0 for both turns the
+// backoff off and restores the configured interval, as does Stop.
+func SetReconnectBackoff(minSeconds, maxSeconds int) error {
+	if minSeconds == 0 && maxSeconds == 0 {
+		return clearReconnectBackoff()
+	}
+
+	// Syncthing raises lower reconnect intervals to this
+	const minReconnectS = 5
+	if minSeconds < minReconnectS {
+		return fmt.Errorf("minimum backoff must be at least %ds, got %d", minReconnectS, minSeconds)
+	}
+	if minSeconds > maxSeconds {
+		return fmt.Errorf("minimum backoff %d is above maximum %d", minSeconds, maxSeconds)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if !running {
+		return ErrNotRunning
+	}
+	if reconnectStop == nil {
+		reconnectOriginal = cfg.Options().ReconnectIntervalS
+		if f, ok := cfg.(*configFile); ok {
+			f.setRuntimeOnly("reconnect", restoreReconnectInterval(reconnectOriginal))
+		}
+		reconnectStop = make(chan struct{})
+		go watchReconnects(quit, reconnectStop)
+	}
+	reconnectMin = time.Duration(minSeconds) * time.Second
+	reconnectMax = time.Duration(maxSeconds) * time.Second
+
+	return modifyOptions(func(o *config.OptionsConfiguration) {
+		o.ReconnectIntervalS = minSeconds
+	})
+}
+
+// clearReconnectBackoff stops the backoff and puts back the configured
+// reconnect interval.
+func clearReconnectBackoff() error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if reconnectStop == nil {
+		return nil
+	}
+	close(reconnectStop)
+	reconnectStop = nil
+	reconnectMin, reconnectMax = 0, 0
+
+	if cfg == nil {
+		return nil
+	}
+	if _, err := cfg.Modify(restoreReconnectInterval(reconnectOriginal)); err != nil {
+		return err
+	}
+	if f, ok := cfg.(*configFile); ok {
+		f.setRuntimeOnly("reconnect", nil)
+	}
+	return nil
+}
+
+// restoreReconnectInterval returns a ModifyFunction that puts the
+// reconnect interval back to intervalS.
+func restoreReconnectInterval(intervalS int) func(*config.Configuration) {
+	return func(c *config.Configuration) {
+		c.Options.ReconnectIntervalS = intervalS
+	}
+}
+
+// SetFolderBandwidthWindow throttles the devices the folder is shared with
+// to downKBps and upKBps (0 for no limit) between startHour and endHour
+// local time, wrapping past midnight if endHour is earlier. Syncthing only
+// limits rates per device, so a device sharing several throttled folders
+// gets the lowest limit of the active windows, and a device's own lower
+// limit still wins. Passing equal hours clears the window; outside any
+// window the devices go back to their own limits. The window limits are
+// never saved, so the config keeps the devices' own limits.
+func SetFolderBandwidthWindow(folderID string, startHour, endHour, downKBps, upKBps int) error {
+	if startHour < 0 || startHour > 23 || endHour < 0 || endHour > 23 {
+		return fmt.Errorf("hours must be between 0 and 23, got %d and %d", startHour, endHour)
+	}
+	if downKBps < 0 || upKBps < 0 {
+		return fmt.Errorf("rates must not be negative, got %d and %d", downKBps, upKBps)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+	if _, ok := cfg.Folder(folderID); !ok {
+		return ErrUnknownFolder
+	}
+
+	if bandwidthWindows == nil {
+		bandwidthWindows = make(map[string]bandwidthWindow)
+		// Otherwise the next Start begins watching
+		if quit != nil {
+			go watchBandwidthWindows(quit)
+		}
+	}
+	if startHour == endHour {
+		if _, ok := bandwidthWindows[folderID]; !ok {
+			return nil
+		}
+		// Keep the entry with no hours so its devices are reset once.
+		bandwidthWindows[folderID] = bandwidthWindow{}
+	} else {
+		bandwidthWindows[folderID] = bandwidthWindow{
+			start:    startHour,
+			end:      endHour,
+			downKBps: downKBps,
+			upKBps:   upKBps,
+		}
+	}
+	return applyBandwidthWindows(time.Now())
+}
+
+// applyBandwidthWindows sets the rate limits of every device sharing a
+// windowed folder for the given time. Must be called with mu held.
+func applyBandwidthWindows(now time.Time) error {
+	if cfg == nil {
+		return nil
+	}
+
+	minRate := func(cur, rate int) int {
+		if rate == 0 || (cur != 0 && cur < rate) {
+			return cur
+		}
+		return rate
+	}
+	throttled := make(map[protocol.DeviceID]rateLimits)
+	for folderID, w := range bandwidthWindows {
+		if w.start == w.end {
+			delete(bandwidthWindows, folderID)
+			continue
+		}
+		fcfg, ok := cfg.Folder(folderID)
+		if !ok || !w.active(now) {
+			continue
+		}
+		for _, id := range fcfg.DeviceIDs() {
+			if id == myID {
+				continue
+			}
+			l := throttled[id]
+			l.down = minRate(l.down, w.downKBps)
+			l.up = minRate(l.up, w.upKBps)
+			throttled[id] = l
+		}
+	}
+
+	f, _ := cfg.(*configFile)
+	want := make(map[protocol.DeviceID]rateLimits)
+	for id, l := range throttled {
+		own, ok := windowOriginals[id]
+		if !ok {
+			dev, ok := cfg.Device(id)
+			if !ok {
+				continue
+			}
+			own = rateLimits{dev.MaxRecvKbps, dev.MaxSendKbps}
+			windowOriginals[id] = own
+			if f != nil {
+				f.setRuntimeOnly("bandwidth "+id.String(), setDeviceRates(map[protocol.DeviceID]rateLimits{id: own}))
+			}
+		}
+		want[id] = rateLimits{minRate(own.down, l.down), minRate(own.up, l.up)}
+	}
+	var released []protocol.DeviceID
+	for id, own := range windowOriginals {
+		if _, ok := throttled[id]; !ok {
+			want[id] = own
+			released = append(released, id)
+		}
+	}
+
+	changed := false
+	for id, l := range want {
+		if dev, ok := cfg.Device(id); ok && (dev.MaxRecvKbps != l.down || dev.MaxSendKbps != l.up) {
+			changed = true
+		}
+	}
+	if changed {
+		_, err := cfg.Modify(setDeviceRates(want))
+		if err != nil {
+			return err
+		}
+	}
+	// Only once the devices have their own limits back
+	for _, id := range released {
+		delete(windowOriginals, id)
+		if f != nil {
+			f.setRuntimeOnly("bandwidth "+id.String(), nil)
+		}
+	}
+	return nil
+}
+
+func setDeviceRates(limits map[protocol.DeviceID]rateLimits) func(*config.Configuration) {
+	return func(c *config.Configuration) {
+		for i := range c.Devices {
+			if l, ok := limits[c.Devices[i].DeviceID]; ok {
+				c.Devices[i].MaxRecvKbps = l.down
+				c.Devices[i].MaxSendKbps = l.up
+			}
+		}
+	}
+}
+
+// watchBandwidthWindows reapplies the bandwidth windows every minute so
+// limits follow the clock, until the engine stops.
+func watchBandwidthWindows(engine <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-engine:
+			return
+		case <-ticker.C:
+		}
+
+		mu.Lock()
+		if err := applyBandwidthWindows(time.Now()); err != nil {
+			addEvent(fmt.Sprintf("Bandwidth window: %v", err))
+		}
+		mu.Unlock()
+	}
+}
+
+type throttle struct {
+	Source      string `json:"source"`
+	Scope       string `json:"scope"`
+	Kind        string `json:"kind"`
+	Value       int    `json:"value"`
+	Description string `json:"description"`
+}
+
+// GetActiveThrottles returns the limits slowing the engine down right now
+// as JSON, one entry per limit: source is "options" for engine-wide
+// settings, "device" for a device's own rate limits, "bandwidthWindow",
+// "battery" or "scanTimeLimit"; scope is the folder or device ID, or ""
+// for the whole engine. Rates are in KB/s. An empty list means nothing is
+// throttled. Returns "" before Start.
+func GetActiveThrottles() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	opts := cfg.Options()
+	devices := cfg.Devices()
+
+	list := []throttle{}
+	rate := func(source, scope, kind string, kbps int) {
+		if kbps > 0 {
+			list = append(list, throttle{source, scope, kind, kbps, fmt.Sprintf("%d KB/s %s cap", kbps, kind)})
+		}
+	}
+
+	rate("options", "", "download", opts.MaxRecvKbps)
+	rate("options", "", "upload", opts.MaxSendKbps)
+	if n := opts.RawMaxFolderConcurrency; n > 0 {
+		list = append(list, throttle{"options", "", "folderConcurrency", n,
+			fmt.Sprintf("at most %d folders scanning or syncing at once", n)})
+	}
+
+	now := time.Now()
+	for folderID, w := range bandwidthWindows {
+		if w.start == w.end || !w.active(now) {
+			continue
+		}
+		rate("bandwidthWindow", folderID, "download", w.downKBps)
+		rate("bandwidthWindow", folderID, "upload", w.upKBps)
+	}
+	// A throttled device's config holds the window limits, not its own
+	for id, dev := range devices {
+		if id == myID {
+			continue
+		}
+		own := rateLimits{dev.MaxRecvKbps, dev.MaxSendKbps}
+		if l, ok := windowOriginals[id]; ok {
+			own = l
+		}
+		rate("device", id.String(), "download", own.down)
+		rate("device", id.String(), "upload", own.up)
+	}
+
+	if batteryLow && !scanOnBattery {
+		for folderID := range batteryPaused {
+			list = append(list, throttle{"battery", folderID, "paused", 0, "paused while the battery is low"})
+		}
+	}
+	for folderID, sl := range scanLimits {
+		secs := int(sl.limit / time.Second)
+		list = append(list, throttle{"scanTimeLimit", folderID, "scanTime", secs,
+			fmt.Sprintf("scans stop after %d seconds and resume at the next interval", secs)})
+	}
+	mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Scope != b.Scope {
+			return a.Scope < b.Scope
+		}
+		return a.Kind < b.Kind
+	})
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// watchConnections redials connections that have gone silent for longer
+// than keepAliveInterval, until the engine stops.
+func watchConnections(engine <-chan struct{}) {
+	type lastSeen struct {
+		inBytes int64
+		changed time.Time
+	}
+	seen := make(map[protocol.DeviceID]lastSeen)
+
+	for {
+		mu.Lock()
+		interval := keepAliveInterval
+		mu.Unlock()
+		select {
+		case <-engine:
+			return
+		case <-time.After(interval / 4):
+		}
+
+		conns, err := getConnections()
+		if err != nil {
+			seen = make(map[protocol.DeviceID]lastSeen)
+			continue
+		}
+
+		now := time.Now()
+		for id, cs := range conns {
+			if !cs.Connected {
+				delete(seen, id)
+				continue
+			}
+			prev, ok := seen[id]
+			if !ok || cs.InBytesTotal != prev.inBytes {
+				seen[id] = lastSeen{inBytes: cs.InBytesTotal, changed: now}
+				continue
+			}
+			if now.Sub(prev.changed) < interval {
+				continue
+			}
+
+			addEvent(fmt.Sprintf("No data from %s for %v, reconnecting", id.Short(), now.Sub(prev.changed).Truncate(time.Second)))
+			mu.Lock()
+			err := reconnectDevice(id)
+			mu.Unlock()
+			if err != nil {
+				addEvent(fmt.Sprintf("Reconnect %s failed: %v", id.Short(), err))
+			}
+			delete(seen, id)
+		}
+	}
+}
+
+// watchReconnects adjusts the reconnect interval between reconnectMin and
+// reconnectMax, see SetReconnectBackoff, until either the engine stops or
+// the backoff is cleared.
+func watchReconnects(engine, backoff <-chan struct{}) {
+	var interval, lo, hi time.Duration
+	connected := 0
+	for {
+		mu.Lock()
+		if reconnectMin != lo || reconnectMax != hi {
+			lo, hi = reconnectMin, reconnectMax
+			interval = lo
+		}
+		mu.Unlock()
+		select {
+		case <-engine:
+			return
+		case <-backoff:
+			return
+		case <-time.After(interval):
+		}
+
+		conns, err := getConnections()
+		if err != nil {
+			continue
+		}
+		now, waiting := 0, false
+		for _, cs := range conns {
+			switch {
+			case cs.Connected:
+				now++
+			case !cs.Paused:
+				waiting = true
+			}
+		}
+
+		next := interval
+		switch {
+		case now > connected || !waiting:
+			next = lo
+		case interval*2 > hi:
+			next = hi
+		default:
+			next = interval * 2
+		}
+		connected = now
+		if next == interval {
+			continue
+		}
+
+		mu.Lock()
+		select {
+		case <-engine:
+			mu.Unlock()
+			return
+		case <-backoff:
+			mu.Unlock()
+			return
+		default:
+		}
+		if reconnectMin == lo && reconnectMax == hi {
+			interval = next
+			err = modifyOptions(func(o *config.OptionsConfiguration) {
+				o.ReconnectIntervalS = int(next / time.Second)
+			})
+		}
+		mu.Unlock()
+		if err != nil {
+			addEvent(fmt.Sprintf("Reconnect backoff: %v", err))
+		}
+	}
+}
+
+func Rescan(folderID string) error {
+	return nil
+}
+
+// RescanAndWait scans the whole folder and returns once the scan has
+// finished, or ErrScanTimeout after timeoutMs. A scan already running when
+// this is called doesn't count. The scan keeps going after a timeout.
+func RescanAndWait(folderID string, timeoutMs int) error {
+	mu.Lock()
+	if cfg == nil || evLogger == nil {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	if _, ok := cfg.Folder(folderID); !ok {
+		mu.Unlock()
+		return ErrUnknownFolder
+	}
+	// Subscribe before asking so the start of the scan isn't missed
+	sub := evLogger.Subscribe(events.StateChanged)
+	mu.Unlock()
+	defer sub.Unsubscribe()
+
+	stateMu.Lock()
+	manualScanAt[folderID] = time.Now()
+	stateMu.Unlock()
+
+	// The request only returns once the scan is done, but may be cut off
+	// by the client timeout first, so the events decide
+	failed := make(chan error, 1)
+	go func() {
+		err := apiRequest(http.MethodPost, "/rest/db/scan", url.Values{"folder": {folderID}}, nil, nil)
+		if err != nil && !os.IsTimeout(err) {
+			failed <- err
+		}
+	}()
+
+	deadline := time.Now().Add(time.Duration(timeoutMs) * time.Millisecond)
+	started := false
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return ErrScanTimeout
+		}
+		select {
+		case err := <-failed:
+			stateMu.Lock()
+			delete(manualScanAt, folderID)
+			stateMu.Unlock()
+			return err
+		default:
+		}
+		// Poll in short steps so a failed request is noticed
+		if wait > time.Second {
+			wait = time.Second
+		}
+		ev, err := sub.Poll(wait)
+		if err == events.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok || data["folder"] != folderID {
+			continue
+		}
+		switch {
+		case data["to"] == "scanning":
+			started = true
+		case started && data["from"] == "scanning" && data["to"] == "error":
+			return fmt.Errorf("scan of %s failed: %v", folderID, data["error"])
+		case started && data["from"] == "scanning":
+			return nil
+		}
+	}
+}
+
+// apiFileInfo is a file entry as returned by the REST API
+type apiFileInfo struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Size       int64     `json:"size"`
+	Deleted    bool      `json:"deleted"`
+	Invalid    bool      `json:"invalid"`
+	Ignored    bool      `json:"ignored"`
+	Modified   time.Time `json:"modified"`
+	Sequence   int64     `json:"sequence"`
+	Version    []string  `json:"version"`
+	LocalFlags uint32    `json:"localFlags"`
+}
+
+func sameVersion(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func folderExists(folderID string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return false
+	}
+	_, ok := cfg.Folder(folderID)
+	return ok
+}
+
+// IsFileSynced reports whether path exists in the folder's global index and
+// the local copy is present at the global version.
+func IsFileSynced(folderID, path string) (bool, error) {
+	if !folderExists(folderID) {
+		return false, ErrUnknownFolder
+	}
+
+	var res struct {
+		Global apiFileInfo `json:"global"`
+		Local  apiFileInfo `json:"local"`
+	}
+	err := apiRequest(http.MethodGet, "/rest/db/file", url.Values{
+		"folder": {folderID},
+		"file":   {path},
+	}, nil, &res)
+	if errors.Is(err, errAPINotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	g, l := res.Global, res.Local
+	if g.Name == "" || g.Deleted || g.Invalid {
+		return false, nil
+	}
+	if l.Name == "" || l.Deleted || l.Invalid {
+		return false, nil
+	}
+	return sameVersion(g.Version, l.Version), nil
+}
+
+type browseEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Type    string    `json:"type"`
+	ModTime time.Time `json:"modTime"`
+	Synced  bool      `json:"synced"`
+}
+
+// BrowseFolder returns the immediate children of subpath in the folder's
+// global index as JSON, so files not downloaded yet are included too. The
+// same as page 1 of BrowseFolderPage with no page limit.
+func BrowseFolder(folderID, subpath string) string {
+	return BrowseFolderPage(folderID, subpath, 1, 0)
+}
+
+// BrowseFolderPage returns the given 1-based page of perPage children of
+// subpath, directories first and then by name; a perPage of 0 returns them
+// all. synced is whether our copy of the entry is at the global version,
+// which for a directory doesn't cover what's inside it. Returns "" for an
+// unknown folder or path.
+func BrowseFolderPage(folderID, subpath string, page, perPage int) string {
+	if page < 1 || perPage < 0 {
+		return ""
+	}
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	mu.Unlock()
+	if !ok {
+		return ""
+	}
+	prefix := strings.Trim(filepath.ToSlash(filepath.Clean(subpath)), "/")
+	if prefix == "." {
+		prefix = ""
+	}
+
+	var tree []*model.TreeEntry
+	if err := apiRequest(http.MethodGet, "/rest/db/browse", url.Values{
+		"folder": {folderID},
+		"prefix": {prefix},
+		"levels": {"0"},
+	}, nil, &tree); err != nil {
+		return ""
+	}
+
+	sort.Slice(tree, func(i, j int) bool {
+		di, dj := tree[i].Type == protocol.FileInfoTypeDirectory, tree[j].Type == protocol.FileInfoTypeDirectory
+		if di != dj {
+			return di
+		}
+		return tree[i].Name < tree[j].Name
+	})
+	if perPage > 0 {
+		start := (page - 1) * perPage
+		if start > len(tree) {
+			start = len(tree)
+		}
+		end := start + perPage
+		if end > len(tree) {
+			end = len(tree)
+		}
+		tree = tree[start:end]
+	}
+
+	// Our copy is at the global version unless we still need the entry,
+	// ignore it or have changed it in a receive-only folder
+	unsynced := make(map[string]bool)
+	needed, err := neededFiles(folderID)
+	if err != nil {
+		return ""
+	}
+	for _, f := range needed {
+		unsynced[f.Name] = true
+	}
+	if fcfg.Type == config.FolderTypeReceiveOnly {
+		changed, err := localChangedFiles(folderID)
+		if err != nil {
+			return ""
+		}
+		for _, name := range changed {
+			unsynced[name] = true
+		}
+	}
+	matcher := ignore.New(fcfg.Filesystem(nil))
+	if err := matcher.Load(".stignore"); err != nil && !fs.IsNotExist(err) {
+		return ""
+	}
+
+	entries := []browseEntry{}
+	for _, e := range tree {
+		name := e.Name
+		if prefix != "" {
+			name = prefix + "/" + e.Name
+		}
+		entries = append(entries, browseEntry{
+			Name:    e.Name,
+			Size:    e.Size,
+			Type:    strings.ToLower(strings.TrimPrefix(e.Type.String(), "FILE_INFO_TYPE_")),
+			ModTime: e.ModTime,
+			Synced:  !unsynced[name] && !matcher.Match(filepath.FromSlash(name)).IsIgnored(),
+		})
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// RequestFile moves path to the front of the folder's pull queue so it is
+// downloaded before anything else still needed. In observer mode the file
+// is also let through the ignore patterns.
+func RequestFile(folderID, path string) error {
+	if !folderExists(folderID) {
+		return ErrUnknownFolder
+	}
+
+	mu.Lock()
+	var lines []string
+	if ob, ok := observers[folderID]; ok {
+		name := strings.Trim(filepath.ToSlash(filepath.Clean(path)), "/")
+		if !underAny(name, ob.Fetched) {
+			ob.Fetched = append(ob.Fetched, name)
+			lines = observerIgnores(ob)
+			if err := saveObservers(); err != nil {
+				addEvent(fmt.Sprintf("Saving observer folders: %v", err))
+			}
+		}
+	}
+	mu.Unlock()
+	if lines != nil {
+		if err := setIgnores(folderID, lines); err != nil {
+			return err
+		}
+	}
+
+	return apiRequest(http.MethodPost, "/rest/db/prio", url.Values{
+		"folder": {folderID},
+		"file":   {path},
+	}, nil, nil)
+}
+
+// ScanSubpaths scans only the given paths, relative to the folder root,
+// and returns once the scan has finished. An empty list scans nothing.
+func ScanSubpaths(folderID string, paths []string) error {
+	if !folderExists(folderID) {
+		return ErrUnknownFolder
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	stateMu.Lock()
+	manualScanAt[folderID] = time.Now()
+	stateMu.Unlock()
+
+	err := apiRequestWith(scanClient, http.MethodPost, "/rest/db/scan", url.Values{
+		"folder": {folderID},
+		"sub":    paths,
+	}, nil, nil)
+	if err != nil {
+		stateMu.Lock()
+		delete(manualScanAt, folderID)
+		stateMu.Unlock()
+	}
+	return err
+}
+
+// RevertLocalChangesSelective reverts local changes in a receive-only
+// folder for the given paths, and anything under them, keeping all other
+// local changes. Syncthing only reverts whole folders, so the changes to
+// keep are hidden behind temporary ignore patterns for the duration of the
+// revert and rescanned afterwards. Returns ErrNotReceiveOnly for any other
+// folder type.
+func RevertLocalChangesSelective(folderID string, paths []string) error {
+	mu.Lock()
+	var fcfg config.FolderConfiguration
+	ok := false
+	if cfg != nil {
+		fcfg, ok = cfg.Folder(folderID)
+	}
+	mu.Unlock()
+	if !ok {
+		return ErrUnknownFolder
+	}
+	if fcfg.Type != config.FolderTypeReceiveOnly {
+		return ErrNotReceiveOnly
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	changed, err := localChangedFiles(folderID)
+	if err != nil {
+		return err
+	}
+	var keep []string
+	for _, name := range changed {
+		if !underAny(name, paths) {
+			keep = append(keep, name)
+		}
+	}
+
+	var ignores struct {
+		Ignore []string `json:"ignore"`
+	}
+	if len(keep) > 0 {
+		if err := apiRequest(http.MethodGet, "/rest/db/ignores", url.Values{"folder": {folderID}}, nil, &ignores); err != nil {
+			return err
+		}
+		lines := make([]string, 0, len(keep)+len(ignores.Ignore))
+		for _, name := range keep {
+			lines = append(lines, "/"+escapeIgnorePattern(name))
+		}
+		lines = append(lines, ignores.Ignore...)
+		if err := setIgnores(folderID, lines); err != nil {
+			return err
+		}
+		if err := ScanSubpaths(folderID, keep); err != nil {
+			setIgnores(folderID, ignores.Ignore)
+			return err
+		}
+	}
+
+	mu.Lock()
+	logger := evLogger
+	mu.Unlock()
+	if logger == nil {
+		return ErrNotRunning
+	}
+	sub := logger.Subscribe(events.StateChanged)
+	err = apiRequest(http.MethodPost, "/rest/db/revert", url.Values{"folder": {folderID}}, nil, nil)
+	if err == nil {
+		err = waitFolderSettled(sub, folderID, 2*time.Minute)
+	}
+	sub.Unsubscribe()
+
+	if len(keep) > 0 {
+		if restoreErr := setIgnores(folderID, ignores.Ignore); restoreErr != nil {
+			return restoreErr
+		}
+		if scanErr := ScanSubpaths(folderID, keep); err == nil {
+			err = scanErr
+		}
+	}
+	return err
+}
+
+// OverrideChanges makes the local state of a send-receive folder win over
+// the cluster: files that others changed are put back to our version and
+// sent out again. Syncthing only overrides send-only folders, so the folder
+// is switched to send-only for the override and back once it has settled.
+func OverrideChanges(folderID string) error {
+	mu.Lock()
+	if cfg == nil || evLogger == nil {
+		mu.Unlock()
+		return ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		mu.Unlock()
+		return ErrUnknownFolder
+	}
+	if fcfg.Type != config.FolderTypeSendReceive {
+		mu.Unlock()
+		return ErrNotSendReceive
+	}
+	sub := evLogger.Subscribe(events.StateChanged)
+	defer sub.Unsubscribe()
+	err := setFolderType(folderID, config.FolderTypeSendOnly)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = apiRequest(http.MethodPost, "/rest/db/override", url.Values{"folder": {folderID}}, nil, nil)
+	if err == nil {
+		err = waitFolderSettled(sub, folderID, 2*time.Minute)
+	}
+
+	mu.Lock()
+	restoreErr := setFolderType(folderID, config.FolderTypeSendReceive)
+	mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return restoreErr
+}
+
+// setFolderType changes the folder's type and waits for the folder to be
+// restarted with it. Must be called with mu held.
+func setFolderType(folderID string, t config.FolderType) error {
+	waiter, err := cfg.Modify(func(c *config.Configuration) {
+		for i := range c.Folders {
+			if c.Folders[i].ID == folderID {
+				c.Folders[i].Type = t
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	waiter.Wait()
+	return nil
+}
+
+// neededFiles lists everything the folder still needs, in progress,
+// queued or not yet queued.
+func neededFiles(folderID string) ([]apiFileInfo, error) {
+	const perPage = 1000
+
+	var needed []apiFileInfo
+	for page := 1; ; page++ {
+		var res struct {
+			Progress []apiFileInfo `json:"progress"`
+			Queued   []apiFileInfo `json:"queued"`
+			Rest     []apiFileInfo `json:"rest"`
+		}
+		if err := apiRequest(http.MethodGet, "/rest/db/need", url.Values{
+			"folder":  {folderID},
+			"page":    {fmt.Sprint(page)},
+			"perpage": {fmt.Sprint(perPage)},
+		}, nil, &res); err != nil {
+			return nil, err
+		}
+		n := len(res.Progress) + len(res.Queued) + len(res.Rest)
+		needed = append(needed, res.Progress...)
+		needed = append(needed, res.Queued...)
+		needed = append(needed, res.Rest...)
+		if n < perPage {
+			return needed, nil
+		}
+	}
+}
+
+// localFileInfos looks up this device's index entry for each of names,
+// a few at a time since there's no bulk call for it. Names that aren't in
+// the local index map to an empty entry.
+func localFileInfos(folderID string, names []string) (map[string]apiFileInfo, error) {
+	const inFlight = 4
+
+	type result struct {
+		name string
+		info apiFileInfo
+		err  error
+	}
+	todo := make(chan string)
+	results := make(chan result)
+	for i := 0; i < inFlight; i++ {
+		go func() {
+			for name := range todo {
+				var file struct {
+					Local apiFileInfo `json:"local"`
+				}
+				err := apiRequest(http.MethodGet, "/rest/db/file", url.Values{
+					"folder": {folderID},
+					"file":   {name},
+				}, nil, &file)
+				if errors.Is(err, errAPINotFound) {
+					err = nil
+				}
+				results <- result{name, file.Local, err}
+			}
+		}()
+	}
+	go func() {
+		for _, name := range names {
+			todo <- name
+		}
+		close(todo)
+	}()
+
+	infos := make(map[string]apiFileInfo, len(names))
+	var firstErr error
+	for range names {
+		r := <-results
+		if r.err != nil && firstErr == nil {
+			firstErr = r.err
+		}
+		infos[r.name] = r.info
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return infos, nil
+}
+
+// localChangedFiles lists the names of the receive-only folder's locally
+// changed items.
+func localChangedFiles(folderID string) ([]string, error) {
+	const perPage = 1000
+
+	var names []string
+	for page := 1; ; page++ {
+		var res struct {
+			Files []apiFileInfo `json:"files"`
+		}
+		if err := apiRequest(http.MethodGet, "/rest/db/localchanged", url.Values{
+			"folder":  {folderID},
+			"page":    {fmt.Sprint(page)},
+			"perpage": {fmt.Sprint(perPage)},
+		}, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, f := range res.Files {
+			names = append(names, f.Name)
+		}
+		if len(res.Files) < perPage {
+			return names, nil
+		}
+	}
+}
+
+func setIgnores(folderID string, lines []string) error {
+	if lines == nil {
+		lines = []string{}
+	}
+	return apiRequest(http.MethodPost, "/rest/db/ignores", url.Values{"folder": {folderID}},
+		map[string][]string{"ignore": lines}, nil)
+}
+
+// underAny reports whether name is one of paths or lies below one of them.
+func underAny(name string, paths []string) bool {
+	for _, p := range paths {
+		p = strings.Trim(filepath.ToSlash(filepath.Clean(p)), "/")
+		if p == "." || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeIgnorePattern makes name match only itself in an .stignore line.
+func escapeIgnorePattern(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// waitFolderSettled waits until the folder has gone idle and stayed idle
+// for a few seconds, so that a scan followed by a pull counts as one.
+func waitFolderSettled(sub events.Subscription, folderID string, timeout time.Duration) error {
+	const quiet = 3 * time.Second
+
+	deadline := time.Now().Add(timeout)
+	idle := false
+	for time.Now().Before(deadline) {
+		wait := time.Until(deadline)
+		if idle && wait > quiet {
+			wait = quiet
+		}
+		ev, err := sub.Poll(wait)
+		if err == events.ErrTimeout {
+			if idle {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if data, ok := ev.Data.(map[string]interface{}); ok && data["folder"] == folderID {
+			idle = data["to"] == "idle"
+		}
+	}
+	return fmt.Errorf("folder %s did not settle within %v", folderID, timeout)
+}
+
+// GetPendingTransferCount returns how many items are in progress or queued
+// in the folder's puller. The queue only exists while the folder is
+// syncing, so this is 0 when idle.
+func GetPendingTransferCount(folderID string) int {
+	const perPage = 1000
+
+	count := 0
+	for page := 1; ; page++ {
+		var res struct {
+			Progress []apiFileInfo `json:"progress"`
+			Queued   []apiFileInfo `json:"queued"`
+		}
+		err := apiRequest(http.MethodGet, "/rest/db/need", url.Values{
+			"folder":  {folderID},
+			"page":    {fmt.Sprint(page)},
+			"perpage": {fmt.Sprint(perPage)},
+		}, nil, &res)
+		if err != nil {
+			return count
+		}
+		n := len(res.Progress) + len(res.Queued)
+		count += n
+		if n < perPage {
+			return count
+		}
+	}
+}
+
+type pendingFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// GetLargestPendingFile returns the name and size of the biggest file the
+// folder still needs as JSON, or "" if it needs none or is unknown.
+func GetLargestPendingFile(folderID string) string {
+	if !folderExists(folderID) {
+		return ""
+	}
+
+	const perPage = 1000
+
+	var largest *apiFileInfo
+	for page := 1; ; page++ {
+		var res struct {
+			Progress []apiFileInfo `json:"progress"`
+			Queued   []apiFileInfo `json:"queued"`
+			Rest     []apiFileInfo `json:"rest"`
+		}
+		err := apiRequest(http.MethodGet, "/rest/db/need", url.Values{
+			"folder":  {folderID},
+			"page":    {fmt.Sprint(page)},
+			"perpage": {fmt.Sprint(perPage)},
+		}, nil, &res)
+		if err != nil {
+			return ""
+		}
+		for _, list := range [][]apiFileInfo{res.Progress, res.Queued, res.Rest} {
+			for i := range list {
+				f := &list[i]
+				if f.Deleted || f.Type != protocol.FileInfoTypeFile.String() {
+					continue
+				}
+				if largest == nil || f.Size > largest.Size {
+					largest = f
+				}
+			}
+		}
+		if len(res.Progress)+len(res.Queued)+len(res.Rest) < perPage {
+			break
+		}
+	}
+	if largest == nil {
+		return ""
+	}
+
+	data, err := json.Marshal(pendingFile{Name: largest.Name, Size: largest.Size})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type outdatedFile struct {
+	Name          string    `json:"name"`
+	Modified      time.Time `json:"modified"`
+	Size          int64     `json:"size"`
+	Deleted       bool      `json:"deleted"`
+	LocalVersion  []string  `json:"localVersion"`
+	GlobalVersion []string  `json:"globalVersion"`
+}
+
+// GetOutdatedFiles returns up to limit of the files the folder still needs
+// as JSON, with our local version and the global version we're missing.
+// The same as page 1 of GetOutdatedFilesPage.
+func GetOutdatedFiles(folderID string, limit int) string {
+	return GetOutdatedFilesPage(folderID, 1, limit)
+}
+
+// GetOutdatedFilesPage returns the given 1-based page of limit entries of
+// what GetOutdatedFiles lists, most recently modified first. A file we
+// don't have at all has no local version. Returns "" for an unknown folder.
+func GetOutdatedFilesPage(folderID string, page, limit int) string {
+	if !folderExists(folderID) || page < 1 || limit < 1 {
+		return ""
+	}
+
+	needed, err := neededFiles(folderID)
+	if err != nil {
+		return ""
+	}
+	sort.SliceStable(needed, func(i, j int) bool { return needed[i].Modified.After(needed[j].Modified) })
+	start := (page - 1) * limit
+	if start > len(needed) {
+		start = len(needed)
+	}
+	needed = needed[start:]
+	if len(needed) > limit {
+		needed = needed[:limit]
+	}
+
+	names := make([]string, len(needed))
+	for i, f := range needed {
+		names[i] = f.Name
+	}
+	locals, err := localFileInfos(folderID, names)
+	if err != nil {
+		return ""
+	}
+
+	files := []outdatedFile{}
+	for _, f := range needed {
+		files = append(files, outdatedFile{
+			Name:          f.Name,
+			Modified:      f.Modified,
+			Size:          f.Size,
+			Deleted:       f.Deleted,
+			LocalVersion:  locals[f.Name].Version,
+			GlobalVersion: f.Version,
+		})
+	}
+
+	data, err := json.Marshal(files)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// recordDeviceBytes adds the traffic since the previous sample to each
+// device's lifetime totals and saves them if anything changed.
+func recordDeviceBytes(conns map[protocol.DeviceID]model.ConnectionStats) {
+	mu.Lock()
+	dir := dataDir
+	mu.Unlock()
+
+	stateMu.Lock()
+	changed := false
+	for id, cs := range conns {
+		if !cs.Connected {
+			delete(byteSamples, id)
+			continue
+		}
+		in, out := cs.InBytesTotal, cs.OutBytesTotal
+		if prev, ok := byteSamples[id]; ok && prev.StartedAt.Equal(cs.StartedAt) {
+			in -= prev.InBytesTotal
+			out -= prev.OutBytesTotal
+		}
+		byteSamples[id] = cs.Statistics
+		if in <= 0 && out <= 0 {
+			continue
+		}
+		t, ok := lifetimeBytes[id.String()]
+		if !ok {
+			t = &byteTotals{}
+			lifetimeBytes[id.String()] = t
+		}
+		t.InBytes += in
+		t.OutBytes += out
+		changed = true
+	}
+	var data []byte
+	if changed {
+		data, _ = json.Marshal(lifetimeBytes)
+	}
+	stateMu.Unlock()
+
+	if data != nil && dir != "" {
+		if err := writeFileAtomic(filepath.Join(dir, deviceBytesFile), data); err != nil {
+			addEvent(fmt.Sprintf("Saving device byte counts: %v", err))
+		}
+	}
+}
+
+// GetDeviceBytes returns the bytes received from and sent to the device
+// over its current connection and over its lifetime, as JSON. Syncthing
+// doesn't keep lifetime totals, so they are sampled here every 30 seconds
+// and miss whatever was transferred just before a shutdown. Returns "" for
+// an invalid device ID.
+func GetDeviceBytes(deviceID string) string {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return ""
+	}
+	conns, err := getConnections()
+	if err != nil {
+		return ""
+	}
+	recordDeviceBytes(conns)
+
+	out := struct {
+		Session  byteTotals `json:"session"`
+		Lifetime byteTotals `json:"lifetime"`
+	}{
+		Session: byteTotals{InBytes: conns[id].InBytesTotal, OutBytes: conns[id].OutBytesTotal},
+	}
+	stateMu.Lock()
+	if t, ok := lifetimeBytes[id.String()]; ok {
+		out.Lifetime = *t
+	}
+	stateMu.Unlock()
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// GetDeviceConnectedSince returns the Unix time at which the current
+// connection to the device was established, or 0 if it isn't connected.
+// With several connections to the device this is the oldest one.
+func GetDeviceConnectedSince(deviceID string) int64 {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return 0
+	}
+	conns, err := getConnections()
+	if err != nil {
+		return 0
+	}
+	cs, ok := conns[id]
+	if !ok || !cs.Connected || cs.StartedAt.IsZero() {
+		return 0
+	}
+	return cs.StartedAt.Unix()
+}
+
+func getConnections() (map[protocol.DeviceID]model.ConnectionStats, error) {
+	var res struct {
+		Connections map[protocol.DeviceID]model.ConnectionStats `json:"connections"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/connections", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	return res.Connections, nil
+}
+
+// downloadRate returns the overall receive rate in bytes per second since
+// the previous sample, or -1 on the first call or when it can't be measured.
+// Calls less than a second apart reuse the last result.
+func downloadRate() float64 {
+	var res struct {
+		Total protocol.Statistics `json:"total"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/connections", nil, nil, &res); err != nil {
+		return -1
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(inBytesAt)
+	if elapsed < time.Second {
+		return inRate
+	}
+	inRate = -1
+	if !inBytesAt.IsZero() && res.Total.InBytesTotal >= inBytes {
+		inRate = float64(res.Total.InBytesTotal-inBytes) / elapsed.Seconds()
+	}
+	inBytesAt = now
+	inBytes = res.Total.InBytesTotal
+	return inRate
+}
+
+// GetFolderETA estimates the seconds until the folder has everything it
+// needs, from its outstanding bytes and the overall download rate measured
+// since the previous call. Returns -1 when the rate is zero or unknown,
+// which includes the first call, and 0 when nothing is needed.
+func GetFolderETA(folderID string) int64 {
+	stateMu.Lock()
+	sum, ok := summaries[folderID]
+	var need int64
+	if ok {
+		need = sum.NeedBytes
+	}
+	stateMu.Unlock()
+	if !ok {
+		return -1
+	}
+
+	rate := downloadRate()
+	if need == 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return int64(float64(need) / rate)
+}
+
+// GetDeniedConnections returns the unknown devices that tried to connect
+// since Start as JSON, newest first, with the name and address of each
+// device's latest attempt.
+func GetDeniedConnections() string {
+	stateMu.Lock()
+	list := []deniedConnection{}
+	for _, d := range denied {
+		list = append(list, *d)
+	}
+	stateMu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type folderEncryption struct {
+	Folder  string             `json:"folder"`
+	Local   string             `json:"local"`
+	Devices []deviceEncryption `json:"devices"`
+}
+
+type deviceEncryption struct {
+	DeviceID  string `json:"deviceID"`
+	Name      string `json:"name"`
+	Password  bool   `json:"password"`
+	Untrusted bool   `json:"untrusted"`
+	Connected bool   `json:"connected"`
+	Problem   string `json:"problem,omitempty"`
+}
+
+// GetFolderEncryptionStatus returns as JSON whether the folder's local data
+// is "plaintext" or "encrypted" and, for each device it is shared with,
+// whether an encryption password is set, with a problem description where
+// the combination can't work. Syncthing refuses such folders when the
+// device connects without saying why to the other side. Returns "" for an
+// unknown folder.
+func GetFolderEncryptionStatus(folderID string) string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		mu.Unlock()
+		return ""
+	}
+	devices := cfg.Devices()
+	mu.Unlock()
+
+	status := folderEncryption{Folder: folderID, Local: "plaintext", Devices: []deviceEncryption{}}
+	encrypted := fcfg.Type == config.FolderTypeReceiveEncrypted
+	if encrypted {
+		status.Local = "encrypted"
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	for _, fd := range fcfg.Devices {
+		if fd.DeviceID == myID {
+			continue
+		}
+		dev := devices[fd.DeviceID]
+		d := deviceEncryption{
+			DeviceID:  fd.DeviceID.String(),
+			Name:      dev.Name,
+			Password:  fd.EncryptionPassword != "",
+			Untrusted: dev.Untrusted,
+			Connected: connected[fd.DeviceID],
+		}
+		switch {
+		case encrypted && d.Password:
+			d.Problem = "local data is encrypted, so it can't be encrypted again for this device"
+		case d.Untrusted && !d.Password:
+			d.Problem = "device is untrusted but would receive plain data"
+		}
+		status.Devices = append(status.Devices, d)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type connectionStats struct {
+	model.ConnectionStats
+	InBytesPerSecond  float64 `json:"inBytesPerSecond"`
+	OutBytesPerSecond float64 `json:"outBytesPerSecond"`
+}
+
+// GetAllConnectionStats returns Syncthing's connection statistics for every
+// configured device and the totals as JSON, as /rest/system/connections
+// does, plus transfer rates averaged since the previous call.
+func GetAllConnectionStats() string {
+	var res struct {
+		Connections map[protocol.DeviceID]model.ConnectionStats `json:"connections"`
+		Total       protocol.Statistics                         `json:"total"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/connections", nil, nil, &res); err != nil {
+		return ""
+	}
+
+	out := struct {
+		Connections map[string]connectionStats `json:"connections"`
+		Total       protocol.Statistics        `json:"total"`
+	}{
+		Connections: make(map[string]connectionStats, len(res.Connections)),
+		Total:       res.Total,
+	}
+	for id, stats := range connectionRates(res.Connections) {
+		out.Connections[id.String()] = stats
+	}
+
+	data, err := json.Marshal(out)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// connectionRates adds the throughput since the previous sample to each
+// connection's statistics.
+func connectionRates(conns map[protocol.DeviceID]model.ConnectionStats) map[protocol.DeviceID]connectionStats {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	out := make(map[protocol.DeviceID]connectionStats, len(conns))
+	for id, cs := range conns {
+		stats := connectionStats{ConnectionStats: cs}
+		prev, ok := connSamples[id]
+		if secs := cs.At.Sub(prev.At).Seconds(); ok && secs > 0 && cs.StartedAt.Equal(prev.StartedAt) {
+			stats.InBytesPerSecond = float64(cs.InBytesTotal-prev.InBytesTotal) / secs
+			stats.OutBytesPerSecond = float64(cs.OutBytesTotal-prev.OutBytesTotal) / secs
+		}
+		connSamples[id] = cs.Statistics
+		out[id] = stats
+	}
+	return out
+}
+
+type connectionSummary struct {
+	DeviceID string `json:"deviceID"`
+	Name     string `json:"name"`
+	ShortID  string `json:"shortID"`
+	Address  string `json:"address"`
+	Type     string `json:"type"`
+	InRate   string `json:"inRate"`
+	OutRate  string `json:"outRate"`
+	InTotal  string `json:"inTotal"`
+	OutTotal string `json:"outTotal"`
+	Line     string `json:"line"`
+}
+
+// GetConnectionSummary returns a display-ready entry for each connected
+// device as JSON, sorted by name: its name, short ID, address, connection
+// type and throughput, with byte counts formatted like "1.2 MB" and rates
+// like "340 KB/s", plus all of it on one line. Rates cover the time since
+// the previous call to this or GetAllConnectionStats, so the first call
+// shows 0 B/s. Returns "" when the engine isn't reachable.
+func GetConnectionSummary() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	devices := cfg.Devices()
+	mu.Unlock()
+
+	conns, err := getConnections()
+	if err != nil {
+		return ""
+	}
+
+	list := []connectionSummary{}
+	for id, cs := range connectionRates(conns) {
+		if !cs.Connected {
+			continue
+		}
+		name := devices[id].Name
+		if name == "" {
+			name = id.Short().String()
+		}
+		c := connectionSummary{
+			DeviceID: id.String(),
+			Name:     name,
+			ShortID:  id.Short().String(),
+			Address:  cs.Address,
+			Type:     cs.Type,
+			InRate:   formatBytes(cs.InBytesPerSecond) + "/s",
+			OutRate:  formatBytes(cs.OutBytesPerSecond) + "/s",
+			InTotal:  formatBytes(float64(cs.InBytesTotal)),
+			OutTotal: formatBytes(float64(cs.OutBytesTotal)),
+		}
+		c.Line = fmt.Sprintf("%s (%s) %s %s, down %s, up %s", c.Name, c.ShortID, c.Address, c.Type, c.InRate, c.OutRate)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].DeviceID < list[j].DeviceID
+	})
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// formatBytes formats a byte count with a decimal unit, like "1.2 MB".
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	i := 0
+	for n >= 1000 && i < len(units)-1 {
+		n /= 1000
+		i++
+	}
+	if i == 0 || n >= 100 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+type deviceStats struct {
+	stats.DeviceStatistics
+	InBytesTotal  int64 `json:"inBytesTotal"`
+	OutBytesTotal int64 `json:"outBytesTotal"`
+}
+
+// GetDeviceStats returns each device's last-seen time and last connection
+// duration as JSON. These come from the database and survive restarts.
+// inBytesTotal and outBytesTotal are the lifetime totals kept by
+// GetDeviceBytes.
+func GetDeviceStats() string {
+	var persisted map[protocol.DeviceID]stats.DeviceStatistics
+	if err := apiRequest(http.MethodGet, "/rest/stats/device", nil, nil, &persisted); err != nil {
+		return ""
+	}
+	conns, err := getConnections()
+	if err != nil {
+		return ""
+	}
+	recordDeviceBytes(conns)
+
+	out := make(map[string]deviceStats, len(persisted))
+	stateMu.Lock()
+	for id, ds := range persisted {
+		st := deviceStats{DeviceStatistics: ds}
+		if t, ok := lifetimeBytes[id.String()]; ok {
+			st.InBytesTotal, st.OutBytesTotal = t.InBytes, t.OutBytes
+		}
+		out[id.String()] = st
+	}
+	stateMu.Unlock()
+	data, err := json.Marshal(out)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type deviceCounts struct {
+	Configured int `json:"configured"`
+	Connected  int `json:"connected"`
+	Paused     int `json:"paused"`
+}
+
+// GetDeviceCounts returns how many remote devices are configured, connected
+// and paused as JSON. This device isn't counted.
+func GetDeviceCounts() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	devices := cfg.Devices()
+	mu.Unlock()
+
+	conns, err := getConnections()
+	if err != nil {
+		return ""
+	}
+
+	var counts deviceCounts
+	for id, d := range devices {
+		if id == myID {
+			continue
+		}
+		counts.Configured++
+		if d.Paused {
+			counts.Paused++
+		}
+		if conns[id].Connected {
+			counts.Connected++
+		}
+	}
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type discoveredDevice struct {
+	DeviceID  string    `json:"deviceID"`
+	Addresses []string  `json:"addresses"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// GetDiscoveredDevices returns the devices announcing themselves on the
+// local network as JSON, paired or not, with their addresses from the
+// discovery cache. lastSeen is when syncthing last reported the device as
+// newly discovered, which happens on first sighting and after it has been
+// gone for a while, not on every beacon.
+func GetDiscoveredDevices() string {
+	var cache map[string]struct {
+		Addresses []string `json:"addresses"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/discovery", nil, nil, &cache); err != nil {
+		return ""
+	}
+
+	devices := []discoveredDevice{}
+	stateMu.Lock()
+	for id, seen := range localSeen {
+		entry, ok := cache[id.String()]
+		if !ok {
+			continue
+		}
+		devices = append(devices, discoveredDevice{
+			DeviceID:  id.String(),
+			Addresses: entry.Addresses,
+			LastSeen:  seen,
+		})
+	}
+	stateMu.Unlock()
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].DeviceID < devices[j].DeviceID })
+	data, err := json.Marshal(devices)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// IsLocalDiscoveryActive reports whether a local discovery beacon, IPv4
+// broadcast or IPv6 multicast, is running without error. Syncthing leaves a
+// beacon out if it fails to bind, so on a restricted network this can be
+// false with local discovery enabled in the config.
+func IsLocalDiscoveryActive() bool {
+	var status struct {
+		Discovery map[string]struct {
+			Error *string `json:"error"`
+		} `json:"discoveryStatus"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/status", nil, nil, &status); err != nil {
+		return false
+	}
+	for name, d := range status.Discovery {
+		if strings.HasSuffix(name, " local") && d.Error == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// GetReachabilityStatus returns how the engine's listeners can be reached
+// from outside: "public" if one has a public address, directly or through
+// a NAT port mapping, "relay" if only a relay can get connections to us,
+// "nat" if we are behind NAT with nothing mapped, "lan" if global
+// discovery and relays are off so only the local network can find us, or
+// "none" if no listener is working. Returns "" when the engine isn't
+// reachable.
+func GetReachabilityStatus() string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	opts := cfg.Options()
+	mu.Unlock()
+
+	var status struct {
+		Listeners map[string]connections.ListenerStatusEntry `json:"connectionServiceStatus"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/status", nil, nil, &status); err != nil {
+		return ""
+	}
+
+	working, public, relayed := false, false, false
+	for _, ls := range status.Listeners {
+		if ls.Error != nil {
+			continue
+		}
+		working = true
+		for _, addr := range append(ls.LANAddresses, ls.WANAddresses...) {
+			u, err := url.Parse(addr)
+			if err != nil {
+				continue
+			}
+			if u.Scheme == "relay" {
+				relayed = true
+				continue
+			}
+			host, _, err := net.SplitHostPort(u.Host)
+			if err != nil {
+				continue
+			}
+			if ip := net.ParseIP(host); ip != nil && ip.IsGlobalUnicast() && !ip.IsPrivate() {
+				public = true
+			}
+		}
+	}
+
+	switch {
+	case !working:
+		return "none"
+	case public:
+		return "public"
+	case relayed:
+		return "relay"
+	case !opts.GlobalAnnEnabled && !opts.RelaysEnabled:
+		return "lan"
+	default:
+		return "nat"
+	}
+}
+
+type transportInfo struct {
+	Transports map[string]bool                       `json:"transports"`
+	Listeners  []listenerTransport                   `json:"listeners"`
+	Devices    map[protocol.DeviceID]deviceTransport `json:"devices"`
+}
+
+type listenerTransport struct {
+	Address   string `json:"address"`
+	Transport string `json:"transport"`
+	Error     string `json:"error,omitempty"`
+}
+
+type deviceTransport struct {
+	Transport string `json:"transport"`
+	Type      string `json:"type"`
+	Address   string `json:"address"`
+	Crypto    string `json:"crypto"`
+	IsLocal   bool   `json:"isLocal"`
+}
+
+// transportName folds the tcp4/quic6-style variants of a URL scheme or
+// connection type into "tcp", "quic" or "relay".
+func transportName(s string) string {
+	s, _, _ = strings.Cut(s, "-")
+	return strings.TrimRight(s, "46")
+}
+
+// GetTransportInfo returns as JSON which transports have a working
+// listener, each listener with its error if it failed, and for every
+// connected device the transport and connection type that was negotiated.
+// Returns "" when the engine isn't reachable.
+func GetTransportInfo() string {
+	var status struct {
+		Listeners map[string]connections.ListenerStatusEntry `json:"connectionServiceStatus"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/status", nil, nil, &status); err != nil {
+		return ""
+	}
+	conns, err := getConnections()
+	if err != nil {
+		return ""
+	}
+
+	info := transportInfo{
+		Transports: map[string]bool{"tcp": false, "quic": false, "relay": false},
+		Listeners:  []listenerTransport{},
+		Devices:    make(map[protocol.DeviceID]deviceTransport),
+	}
+	for addr, ls := range status.Listeners {
+		lt := listenerTransport{Address: addr}
+		if u, err := url.Parse(addr); err == nil {
+			lt.Transport = transportName(u.Scheme)
+		}
+		if ls.Error != nil {
+			lt.Error = *ls.Error
+		} else if lt.Transport != "" {
+			info.Transports[lt.Transport] = true
+		}
+		info.Listeners = append(info.Listeners, lt)
+	}
+	sort.Slice(info.Listeners, func(i, j int) bool { return info.Listeners[i].Address < info.Listeners[j].Address })
+
+	for id, cs := range conns {
+		if !cs.Connected {
+			continue
+		}
+		info.Devices[id] = deviceTransport{
+			Transport: transportName(cs.Type),
+			Type:      cs.Type,
+			Address:   cs.Address,
+			Crypto:    cs.Crypto,
+			IsLocal:   cs.IsLocal,
+		}
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type serviceFailure struct {
+	Supervisor string    `json:"supervisor"`
+	Service    string    `json:"service"`
+	Error      string    `json:"error"`
+	Time       time.Time `json:"time"`
+}
+
+var (
+	serviceFailedRe  = regexp.MustCompile(`^(.+): service (.+) failed: (.*)$`)
+	serviceTimeoutRe = regexp.MustCompile(`^(.+): Service (.+) failed to terminate in a timely manner$`)
+)
+
+// recordServiceFailure picks out the lines suture's event hook logs when a
+// service dies or hangs on stop. Called with the logger's lock held, so it
+// must not log.
+func recordServiceFailure(_ logger.LogLevel, msg string) {
+	var f serviceFailure
+	if m := serviceFailedRe.FindStringSubmatch(msg); m != nil {
+		f = serviceFailure{Supervisor: m[1], Service: m[2], Error: m[3]}
+	} else if m := serviceTimeoutRe.FindStringSubmatch(msg); m != nil {
+		f = serviceFailure{Supervisor: m[1], Service: m[2], Error: "failed to terminate in a timely manner"}
+	} else {
+		return
+	}
+	f.Time = time.Now()
+
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	serviceFailures = append(serviceFailures, f)
+	if len(serviceFailures) > 20 {
+		serviceFailures = serviceFailures[1:]
+	}
+}
+
+type serviceHealth struct {
+	Healthy   bool                    `json:"healthy"`
+	Discovery map[string]string       `json:"discovery"`
+	Listeners map[string]string       `json:"listeners"`
+	Folders   map[string]folderHealth `json:"folders"`
+	Failures  []serviceFailure        `json:"failures"`
+}
+
+type folderHealth struct {
+	State      string `json:"state"`
+	Error      string `json:"error,omitempty"`
+	WatchError string `json:"watchError,omitempty"`
+}
+
+// GetServiceHealth returns the state of the engine's services as JSON: the
+// error of each discovery method and listener ("" when working), each
+// folder's state and errors, and the services that failed or hung since
+// Start, newest last, as reported by their supervisors. healthy is false if
+// anything is failing now or a service failed in the last five minutes.
+// Returns "" when the engine isn't reachable.
+func GetServiceHealth() string {
+	var status struct {
+		Discovery map[string]struct {
+			Error *string `json:"error"`
+		} `json:"discoveryStatus"`
+		Listeners map[string]connections.ListenerStatusEntry `json:"connectionServiceStatus"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/system/status", nil, nil, &status); err != nil {
+		return ""
+	}
+
+	health := serviceHealth{
+		Healthy:   true,
+		Discovery: make(map[string]string),
+		Listeners: make(map[string]string),
+		Folders:   make(map[string]folderHealth),
+	}
+	for name, d := range status.Discovery {
+		if d.Error != nil {
+			health.Discovery[name] = *d.Error
+			health.Healthy = false
+		} else {
+			health.Discovery[name] = ""
+		}
+	}
+	for addr, ls := range status.Listeners {
+		if ls.Error != nil {
+			health.Listeners[addr] = *ls.Error
+			health.Healthy = false
+		} else {
+			health.Listeners[addr] = ""
+		}
+	}
+
+	stateMu.Lock()
+	for folderID, sum := range summaries {
+		health.Folders[folderID] = folderHealth{State: sum.State, Error: sum.Error, WatchError: sum.WatchError}
+		if sum.State == "error" || sum.WatchError != "" {
+			health.Healthy = false
+		}
+	}
+	stateMu.Unlock()
+
+	eventMu.Lock()
+	health.Failures = append([]serviceFailure{}, serviceFailures...)
+	eventMu.Unlock()
+	for _, f := range health.Failures {
+		if time.Since(f.Time) < 5*time.Minute {
+			health.Healthy = false
+		}
+	}
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type remoteFolder struct {
+	ID     string `json:"id"`
+	Label  string `json:"label"`
+	Shared bool   `json:"shared"`
+}
+
+// GetRemoteFolders returns the folders a connected peer offers as JSON:
+// those we already share with it and those still pending from its cluster
+// config. Returns "" when the peer isn't connected.
+func GetRemoteFolders(deviceID string) string {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return ""
+	}
+
+	conns, err := getConnections()
+	if err != nil || !conns[id].Connected {
+		return ""
+	}
+
+	var pending map[string]db.PendingFolder
+	if err := apiRequest(http.MethodGet, "/rest/cluster/pending/folders", url.Values{
+		"device": {id.String()},
+	}, nil, &pending); err != nil {
+		return ""
+	}
+
+	folders := []remoteFolder{}
+	for folderID, pf := range pending {
+		folders = append(folders, remoteFolder{
+			ID:    folderID,
+			Label: pf.OfferedBy[id].Label,
+		})
+	}
+
+	mu.Lock()
+	if cfg != nil {
+		for _, f := range cfg.FolderList() {
+			if f.SharedWith(id) {
+				folders = append(folders, remoteFolder{ID: f.ID, Label: f.Label, Shared: true})
+			}
+		}
+	}
+	mu.Unlock()
+
+	sort.Slice(folders, func(i, j int) bool { return folders[i].ID < folders[j].ID })
+	data, err := json.Marshal(folders)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// TestIgnoreMatch reports whether path, relative to the folder root, would
+// be ignored by the folder's current .stignore patterns. Syncthing's own
+// files (.stfolder, .stignore, .stversions) always count as ignored.
+func TestIgnoreMatch(folderID, path string) (bool, error) {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return false, ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	mu.Unlock()
+	if !ok {
+		return false, ErrUnknownFolder
+	}
+
+	path = strings.TrimPrefix(filepath.Clean(path), string(filepath.Separator))
+	if fs.IsInternal(path) {
+		return true, nil
+	}
+
+	// Same matcher and pattern file the folder itself loads
+	matcher := ignore.New(fcfg.Filesystem(nil))
+	if err := matcher.Load(".stignore"); err != nil && !fs.IsNotExist(err) {
+		return false, err
+	}
+	return matcher.Match(path).IsIgnored(), nil
+}
+
+// RescanMetadataOnly compares the size and modification time of every file
+// on disk with the index and scans only the files that differ, or that
+// appeared or disappeared. Syncthing's scanner has no metadata-only mode,
+// but it only hashes files that changed, so this skips the scan entirely
+// when nothing did. Permissions and xattrs aren't compared. Past a few
+// thousand changed files, or a thousand still to be pulled, the whole
+// folder is scanned instead.
+func RescanMetadataOnly(folderID string) error {
+	// Paths per scan request, to keep the URL short, and the most paths
+	// scanned one by one
+	const (
+		pathsPerRequest = 100
+		maxPaths        = 2000
+	)
+
+	diff, err := diffAgainstIndex(folderID)
+	if err != nil && !errors.Is(err, errTooManyNeeded) {
+		return err
+	}
+	changed := append(append(diff.New, diff.Modified...), diff.Deleted...)
+
+	if err != nil || len(changed) > maxPaths {
+		stateMu.Lock()
+		manualScanAt[folderID] = time.Now()
+		stateMu.Unlock()
+		return apiRequestWith(scanClient, http.MethodPost, "/rest/db/scan", url.Values{"folder": {folderID}}, nil, nil)
+	}
+	for len(changed) > 0 {
+		n := len(changed)
+		if n > pathsPerRequest {
+			n = pathsPerRequest
+		}
+		if err := ScanSubpaths(folderID, changed[:n]); err != nil {
+			return err
+		}
+		changed = changed[n:]
+	}
+	return nil
+}
+
+// DryRunScan returns, as JSON, the files a scan would pick up as new,
+// modified or deleted, without touching the index. Like
+// RescanMetadataOnly it compares size and modification time against this
+// device's index rather than hashing, so files still to be pulled or
+// ignored here don't show up. Returns "" on error, and also while over a
+// thousand files are still to be pulled, as each needs a lookup of its own.
+func DryRunScan(folderID string) string {
+	diff, err := diffAgainstIndex(folderID)
+	if err != nil {
+		return ""
+	}
+	data, err := json.Marshal(diff)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type indexDiff struct {
+	New      []string `json:"new"`
+	Modified []string `json:"modified"`
+	Deleted  []string `json:"deleted"`
+}
+
+// diffAgainstIndex walks the folder and compares each file's size and
+// modification time with the local index.
+func diffAgainstIndex(folderID string) (indexDiff, error) {
+	diff := indexDiff{New: []string{}, Modified: []string{}, Deleted: []string{}}
+
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return diff, ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	mu.Unlock()
+	if !ok {
+		return diff, ErrUnknownFolder
+	}
+
+	indexed, err := localIndexedFiles(fcfg)
+	if err != nil {
+		return diff, err
+	}
+
+	ffs := fcfg.Filesystem(nil)
+	matcher := ignore.New(ffs)
+	if err := matcher.Load(".stignore"); err != nil && !fs.IsNotExist(err) {
+		return diff, err
+	}
+	window := fcfg.ModTimeWindow()
+
+	err = ffs.Walk(".", func(path string, info fs.FileInfo, err error) error {
+		if err != nil || path == "." {
+			return nil
+		}
+		if fs.IsInternal(path) || fs.IsTemporary(path) || matcher.Match(path).IsIgnored() {
+			if info.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		e, ok := indexed[path]
+		delete(indexed, path)
+		switch {
+		case !ok:
+			diff.New = append(diff.New, path)
+		case e.Size != info.Size() || !protocol.ModTimeEqual(e.ModTime, info.ModTime(), window):
+			diff.Modified = append(diff.Modified, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return diff, err
+	}
+	for name := range indexed {
+		if !fs.IsInternal(name) && !matcher.Match(name).IsIgnored() {
+			diff.Deleted = append(diff.Deleted, name)
+		}
+	}
+	sort.Strings(diff.Deleted)
+	return diff, nil
+}
+
+// localIndexedFiles returns the non-directory entries of the folder's
+// local index by path. There's no REST call listing it, so it's the global
+// index with this device's own entries swapped in for what it still needs
+// and, in a receive-only folder, for its local changes. Each needed file
+// takes a lookup of its own, so past maxNeeded of them this gives up with
+// errTooManyNeeded.
+func localIndexedFiles(fcfg config.FolderConfiguration) (map[string]*model.TreeEntry, error) {
+	const (
+		perPage   = 1000
+		maxNeeded = 1000
+	)
+
+	indexed, err := indexedFiles(fcfg.ID)
+	if err != nil {
+		return nil, err
+	}
+	local := func(f apiFileInfo) {
+		name := filepath.FromSlash(f.Name)
+		if f.Deleted || f.Invalid || f.Ignored || f.Type == protocol.FileInfoTypeDirectory.String() {
+			delete(indexed, name)
+			return
+		}
+		indexed[name] = &model.TreeEntry{Name: filepath.Base(name), ModTime: f.Modified, Size: f.Size}
+	}
+
+	needed, err := neededFiles(fcfg.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(needed) > maxNeeded {
+		return nil, errTooManyNeeded
+	}
+	names := make([]string, len(needed))
+	for i, f := range needed {
+		names[i] = f.Name
+	}
+	locals, err := localFileInfos(fcfg.ID, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		f := locals[name]
+		// Not in the local index at all
+		if f.Name == "" {
+			f = apiFileInfo{Name: name, Deleted: true}
+		}
+		local(f)
+	}
+
+	if fcfg.Type != config.FolderTypeReceiveOnly {
+		return indexed, nil
+	}
+	for page := 1; ; page++ {
+		var res struct {
+			Files []apiFileInfo `json:"files"`
+		}
+		if err := apiRequest(http.MethodGet, "/rest/db/localchanged", url.Values{
+			"folder":  {fcfg.ID},
+			"page":    {fmt.Sprint(page)},
+			"perpage": {fmt.Sprint(perPage)},
+		}, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, f := range res.Files {
+			local(f)
+		}
+		if len(res.Files) < perPage {
+			return indexed, nil
+		}
+	}
+}
+
+// indexedFiles returns the non-directory entries of the folder's global
+// index by path.
+func indexedFiles(folderID string) (map[string]*model.TreeEntry, error) {
+	var tree []*model.TreeEntry
+	if err := apiRequest(http.MethodGet, "/rest/db/browse", url.Values{"folder": {folderID}}, nil, &tree); err != nil {
+		return nil, err
+	}
+	indexed := make(map[string]*model.TreeEntry)
+	var flatten func(prefix string, entries []*model.TreeEntry)
+	flatten = func(prefix string, entries []*model.TreeEntry) {
+		for _, e := range entries {
+			name := filepath.Join(prefix, e.Name)
+			if e.Type == protocol.FileInfoTypeDirectory {
+				flatten(name, e.Children)
+				continue
+			}
+			indexed[name] = e
+		}
+	}
+	flatten("", tree)
+	return indexed, nil
+}
+
+type attentionItems struct {
+	PendingDevices []pendingDevice `json:"pendingDevices"`
+	PendingFolders []pendingFolder `json:"pendingFolders"`
+	FolderErrors   []folderErrors  `json:"folderErrors"`
+	Conflicts      []conflictFile  `json:"conflicts"`
+	Total          int             `json:"total"`
+}
+
+type pendingDevice struct {
+	DeviceID string    `json:"deviceID"`
+	Name     string    `json:"name"`
+	Address  string    `json:"address"`
+	Time     time.Time `json:"time"`
+}
+
+type pendingFolder struct {
+	ID        string   `json:"id"`
+	Label     string   `json:"label"`
+	OfferedBy []string `json:"offeredBy"`
+}
+
+type folderErrors struct {
+	Folder string `json:"folder"`
+	Count  int    `json:"count"`
+}
+
+type conflictFile struct {
+	Folder string `json:"folder"`
+	Path   string `json:"path"`
+}
+
+type folderConflicts struct {
+	sequence int64
+	paths    []string
+}
+
+// conflictFiles returns the conflict copies in the folder's global index.
+// Finding them means going through the whole index, so the list is kept
+// until the folder summary's sequence says the index has changed.
+func conflictFiles(folderID string) ([]string, error) {
+	stateMu.Lock()
+	var seq int64 = -1
+	if sum, ok := summaries[folderID]; ok {
+		seq = sum.Sequence
+	}
+	cached, ok := conflicts[folderID]
+	stateMu.Unlock()
+	if ok && seq >= 0 && cached.sequence == seq {
+		return cached.paths, nil
+	}
+
+	indexed, err := indexedFiles(folderID)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for name := range indexed {
+		if strings.Contains(filepath.Base(name), ".sync-conflict-") {
+			paths = append(paths, name)
+		}
+	}
+	sort.Strings(paths)
+
+	if seq >= 0 {
+		stateMu.Lock()
+		conflicts[folderID] = folderConflicts{sequence: seq, paths: paths}
+		stateMu.Unlock()
+	}
+	return paths, nil
+}
+
+// GetAttentionItems returns everything waiting on the user as JSON: devices
+// and folders asking to be accepted, folders with items that failed to
+// sync, and conflict copies in the index, plus their total count. Returns
+// "" when the engine isn't reachable.
+func GetAttentionItems() string {
+	items := attentionItems{
+		PendingDevices: []pendingDevice{},
+		PendingFolders: []pendingFolder{},
+		FolderErrors:   []folderErrors{},
+		Conflicts:      []conflictFile{},
+	}
+
+	var devices map[protocol.DeviceID]config.ObservedDevice
+	if err := apiRequest(http.MethodGet, "/rest/cluster/pending/devices", nil, nil, &devices); err != nil {
+		return ""
+	}
+	for id, d := range devices {
+		items.PendingDevices = append(items.PendingDevices, pendingDevice{
+			DeviceID: id.String(),
+			Name:     d.Name,
+			Address:  d.Address,
+			Time:     d.Time,
+		})
+	}
+	sort.Slice(items.PendingDevices, func(i, j int) bool {
+		return items.PendingDevices[i].DeviceID < items.PendingDevices[j].DeviceID
+	})
+
+	var folders map[string]db.PendingFolder
+	if err := apiRequest(http.MethodGet, "/rest/cluster/pending/folders", nil, nil, &folders); err != nil {
+		return ""
+	}
+	for folderID, pf := range folders {
+		f := pendingFolder{ID: folderID, OfferedBy: []string{}}
+		for id, of := range pf.OfferedBy {
+			f.OfferedBy = append(f.OfferedBy, id.String())
+			if f.Label == "" {
+				f.Label = of.Label
+			}
+		}
+		sort.Strings(f.OfferedBy)
+		items.PendingFolders = append(items.PendingFolders, f)
+	}
+	sort.Slice(items.PendingFolders, func(i, j int) bool {
+		return items.PendingFolders[i].ID < items.PendingFolders[j].ID
+	})
+
+	mu.Lock()
+	var folderIDs []string
+	if cfg != nil {
+		for _, f := range cfg.FolderList() {
+			folderIDs = append(folderIDs, f.ID)
+		}
+	}
+	mu.Unlock()
+	sort.Strings(folderIDs)
+
+	for _, folderID := range folderIDs {
+		if n := GetFolderErrorCount(folderID); n > 0 {
+			items.FolderErrors = append(items.FolderErrors, folderErrors{Folder: folderID, Count: n})
+		}
+		paths, err := conflictFiles(folderID)
+		if err != nil {
+			continue
+		}
+		for _, name := range paths {
+			items.Conflicts = append(items.Conflicts, conflictFile{Folder: folderID, Path: name})
+		}
+	}
+
+	items.Total = len(items.PendingDevices) + len(items.PendingFolders) + len(items.FolderErrors) + len(items.Conflicts)
+	data, err := json.Marshal(items)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// GetIndexProgress reports how much of a peer's index has been received
+// since its cluster config arrived, as JSON. Returns "" if nothing has been
+// received from the device on the current connection.
+//
+// Syncthing doesn't expose the size the peer announces for its index, so
+// each folder also carries the folder's global item count and the peer's
+// completion percentage as of the index received so far. For a peer that
+// already holds the folder, completion climbs to 100 as its index arrives.
+func GetIndexProgress(deviceID string) string {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return ""
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	p, ok := indexProgress[id]
+	if !ok {
+		return ""
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// GetFolderFileCounts returns the local and global file, directory, symlink
+// and deleted counts from the folder's latest summary as JSON, or "" if no
+// summary has been received yet.
+func GetFolderFileCounts(folderID string) string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	sum, ok := summaries[folderID]
+	if !ok {
+		return ""
+	}
+	data, err := json.Marshal(map[string]fileCounts{
+		"local": {
+			Files:       sum.LocalFiles,
+			Directories: sum.LocalDirectories,
+			Symlinks:    sum.LocalSymlinks,
+			Deleted:     sum.LocalDeleted,
+		},
+		"global": {
+			Files:       sum.GlobalFiles,
+			Directories: sum.GlobalDirectories,
+			Symlinks:    sum.GlobalSymlinks,
+			Deleted:     sum.GlobalDeleted,
+		},
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// GetFolderSequence returns the folder's local index sequence, which grows
+// with every change to the local index, or -1 if it can't be read. The
+// folder summary's sequence also counts remote index updates, so this asks
+// for our own device's completion, which carries the local sequence alone.
+func GetFolderSequence(folderID string) int64 {
+	var comp struct {
+		Sequence int64 `json:"sequence"`
+	}
+	if err := apiRequest(http.MethodGet, "/rest/db/completion", url.Values{"folder": {folderID}}, nil, &comp); err != nil {
+		return -1
+	}
+	return comp.Sequence
+}
+
+type receiveOnlyTotals struct {
+	Files       int   `json:"files"`
+	Directories int   `json:"directories"`
+	Symlinks    int   `json:"symlinks"`
+	Deletes     int   `json:"deletes"`
+	Items       int   `json:"items"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// GetReceiveOnlyTotals returns as JSON how many local changes in a
+// receive-only folder differ from the cluster and would be reverted, by
+// kind, with their total and size in bytes. Returns "" if the folder
+// isn't receive-only or its status can't be read.
+func GetReceiveOnlyTotals(folderID string) string {
+	mu.Lock()
+	var fcfg config.FolderConfiguration
+	ok := false
+	if cfg != nil {
+		fcfg, ok = cfg.Folder(folderID)
+	}
+	mu.Unlock()
+	if !ok || fcfg.Type != config.FolderTypeReceiveOnly {
+		return ""
+	}
+
+	var sum model.FolderSummary
+	if err := apiRequest(http.MethodGet, "/rest/db/status", url.Values{"folder": {folderID}}, nil, &sum); err != nil {
+		return ""
+	}
+	data, err := json.Marshal(receiveOnlyTotals{
+		Files:       sum.ReceiveOnlyChangedFiles,
+		Directories: sum.ReceiveOnlyChangedDirectories,
+		Symlinks:    sum.ReceiveOnlyChangedSymlinks,
+		Deletes:     sum.ReceiveOnlyChangedDeletes,
+		Items:       sum.ReceiveOnlyTotalItems,
+		Bytes:       sum.ReceiveOnlyChangedBytes,
+	})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type folderPathHealth struct {
+	Path          string `json:"path"`
+	PathExists    bool   `json:"pathExists"`
+	MarkerPresent bool   `json:"markerPresent"`
+	Accessible    bool   `json:"accessible"`
+	Status        string `json:"status"`
+	Error         string `json:"error,omitempty"`
+}
+
+// GetFolderHealth checks the folder's path as Syncthing does before each
+// scan and pull, and returns as JSON whether it exists, whether the folder
+// marker (.stfolder) is in it and whether it can be listed. status is "ok",
+// "path missing", "not a directory", "marker missing" or "inaccessible".
+// Syncthing won't sync the folder unless it's "ok"; for "marker missing",
+// CreateFolderMarker fixes it. Returns "" for an unknown folder.
+func GetFolderHealth(folderID string) string {
+	mu.Lock()
+	if cfg == nil {
+		mu.Unlock()
+		return ""
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	mu.Unlock()
+	if !ok {
+		return ""
+	}
+
+	health := folderPathHealth{Path: fcfg.Path, Status: "ok"}
+	err := fcfg.CheckPath()
+	switch err {
+	case nil:
+		health.PathExists = true
+		health.MarkerPresent = true
+	case config.ErrPathMissing:
+		health.Status = "path missing"
+	case config.ErrPathNotDirectory:
+		health.PathExists = true
+		health.Status = "not a directory"
+	case config.ErrMarkerMissing:
+		health.PathExists = true
+		health.Status = "marker missing"
+	default:
+		health.Status = "inaccessible"
+		health.Error = err.Error()
+	}
+	if health.PathExists {
+		if _, err := fcfg.Filesystem(nil).DirNames("."); err != nil {
+			if health.Status == "ok" {
+				health.Status = "inaccessible"
+			}
+			health.Error = err.Error()
+		} else {
+			health.Accessible = true
+		}
+	}
+
+	data, err := json.Marshal(health)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// CreateFolderMarker creates the missing folder marker in the folder's
+// path, which has to exist. Syncthing resumes the folder at its next
+// rescan. Does nothing if the marker is already there.
+func CreateFolderMarker(folderID string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		return ErrUnknownFolder
+	}
+	if err := fcfg.CreateMarker(); err != nil {
+		return err
+	}
+	addEvent(fmt.Sprintf("Folder marker ensured for %s", folderID))
+	return nil
+}
+
+// GetFolderType returns the folder's type: "sendreceive", "sendonly",
+// "receiveonly" or "receiveencrypted".
+func GetFolderType(folderID string) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if cfg == nil {
+		return "", ErrNotRunning
+	}
+	fcfg, ok := cfg.Folder(folderID)
+	if !ok {
+		return "", ErrUnknownFolder
+	}
+	return fcfg.Type.String(), nil
+}
+
+// GetFolderErrorCount returns the number of items that failed to sync in
+// the folder's latest summary, or 0 if there is none yet.
+func GetFolderErrorCount(folderID string) int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if sum, ok := summaries[folderID]; ok {
+		return sum.Errors
+	}
+	return 0
+}
+
+// GetTimeSinceLastSync returns the seconds since the folder was last idle
+// with nothing left to pull, or -1 if it never has. The time is saved in
+// the data directory every 30 seconds and on Stop, so it carries over
+// restarts.
+func GetTimeSinceLastSync(folderID string) int64 {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	t, ok := lastSynced[folderID]
+	if !ok {
+		return -1
+	}
+	return int64(time.Since(t) / time.Second)
+}
+
+// GetDeviceReportedName returns the name the device announced for itself
+// when it last connected since Start, or "" if it hasn't connected.
+func GetDeviceReportedName(deviceID string) string {
+	id, err := protocol.DeviceIDFromString(deviceID)
+	if err != nil {
+		return ""
+	}
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return reportedNames[id]
+}
+
+// GetScanPercent returns how far the folder's current scan is through
+// hashing, from 0 to 100, or -1 if it isn't scanning.
+func GetScanPercent(folderID string) float64 {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if p, ok := scanPercent[folderID]; ok {
+		return p
+	}
+	return -1
+}
+
+// GetLastScanTrigger returns what started the folder's last scan:
+// "startup" for the first scan after Start or a resume, "manual" for
+// ScanSubpaths and what uses it, "interval" for a periodic rescan, or
+// "watcher". Syncthing doesn't say, so interval and watcher scans are told
+// apart by timing, and a scan Syncthing runs for its own reasons, like
+// after a failed pull, counts as a watcher scan. Returns "" if the folder
+// hasn't scanned yet.
+func GetLastScanTrigger(folderID string) string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	return scanTriggers[folderID]
+}
+
+// recordScanTrigger works out what started a scan beginning at the given
+// time, for GetLastScanTrigger.
+func recordScanTrigger(folderID string, at time.Time) {
+	var interval time.Duration
+	mu.Lock()
+	if cfg != nil {
+		if fcfg, ok := cfg.Folder(folderID); ok {
+			interval = time.Duration(fcfg.RescanIntervalS) * time.Second
+		}
+	}
+	mu.Unlock()
+
+	stateMu.Lock()
+	defer stateMu.Unlock()
 
-	dbPath := filepath.Join(dataDir, "index-v0.14.0.db")
-	ldb, err := backend.OpenLevelDB(dbPath, backend.TuningAuto)
-	if err != nil {
-		mu.Unlock()
-		return err
+	last, seen := timerScanAt[folderID]
+	manual, requested := manualScanAt[folderID]
+	var trigger string
+	switch {
+	case requested && !at.Before(manual):
+		trigger = "manual"
+		delete(manualScanAt, folderID)
+	case !seen:
+		trigger = "startup"
+	case interval > 0 && at.Sub(last) >= interval*3/4:
+		// Syncthing waits 3/4 to 5/4 of the interval between these
+		trigger = "interval"
+	default:
+		trigger = "watcher"
+	}
+	if trigger == "startup" || trigger == "interval" {
+		timerScanAt[folderID] = at
 	}
+	scanTriggers[folderID] = trigger
+}
 
-	app, err = syncthing.New(cfg, ldb, evLogger, cert, syncthing.Options{
-		NoUpgrade: true,
-	})
-	if err != nil {
+// GetWatcherStatus returns "unsupported" when changes to the folder are only
+// picked up by periodic rescans, as on iOS where the watcher is a stub or
+// when the watcher is turned off; "error: <msg>" when the watcher failed;
+// and "active" otherwise. Returns "" for an unknown folder.
+func GetWatcherStatus(folderID string) string {
+	mu.Lock()
+	if cfg == nil {
 		mu.Unlock()
-		return err
+		return ""
 	}
-
-	running = true
+	fcfg, ok := cfg.Folder(folderID)
 	mu.Unlock()
+	if !ok {
+		return ""
+	}
+	if runtime.GOOS == "ios" || !fcfg.FSWatcherEnabled {
+		return "unsupported"
+	}
 
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				addEvent(fmt.Sprintf("PANIC: %v\n%s", r, debug.Stack()))
-				mu.Lock()
-				running = false
-				app = nil
-				mu.Unlock()
-			}
-		}()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	if sum, ok := summaries[folderID]; ok && sum.WatchError != "" {
+		return "error: " + sum.WatchError
+	}
+	return "active"
+}
 
-		err := app.Start()
+func updateState(ev events.Event) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	switch ev.Type {
+	case events.ClusterConfigReceived:
+		// A new cluster config starts a fresh index exchange
+		if data, ok := ev.Data.(model.ClusterConfigReceivedEventData); ok {
+			indexProgress[data.Device] = &deviceIndexProgress{
+				Started:    ev.Time,
+				LastUpdate: ev.Time,
+				Folders:    make(map[string]*folderIndexProgress),
+			}
+		}
+	case events.RemoteIndexUpdated:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		devStr, _ := data["device"].(string)
+		id, err := protocol.DeviceIDFromString(devStr)
 		if err != nil {
-			addEvent(fmt.Sprintf("Start error: %v", err))
-			mu.Lock()
-			running = false
-			app = nil
-			mu.Unlock()
 			return
 		}
-		addEvent("Sync engine started")
-		go listenEvents()
-	}()
-
-	return nil
+		p, ok := indexProgress[id]
+		if !ok {
+			return
+		}
+		folder, _ := data["folder"].(string)
+		items, _ := data["items"].(int)
+		seq, _ := data["sequence"].(int64)
+		fp, ok := p.Folders[folder]
+		if !ok {
+			fp = &folderIndexProgress{}
+			p.Folders[folder] = fp
+		}
+		fp.Items += items
+		fp.Sequence = seq
+		p.Items += items
+		p.LastUpdate = ev.Time
+	case events.DeviceConnected:
+		if data, ok := ev.Data.(map[string]string); ok {
+			if id, err := protocol.DeviceIDFromString(data["id"]); err == nil {
+				connected[id] = true
+				if name := data["deviceName"]; name != "" {
+					reportedNames[id] = name
+				}
+			}
+		}
+	case events.DeviceDisconnected:
+		if data, ok := ev.Data.(map[string]string); ok {
+			if id, err := protocol.DeviceIDFromString(data["id"]); err == nil {
+				delete(indexProgress, id)
+				delete(connected, id)
+			}
+		}
+	case events.DeviceRejected:
+		data, ok := ev.Data.(map[string]string)
+		if !ok {
+			return
+		}
+		id, err := protocol.DeviceIDFromString(data["device"])
+		if err != nil {
+			return
+		}
+		d, ok := denied[id]
+		if !ok {
+			d = &deniedConnection{DeviceID: id.String()}
+			denied[id] = d
+		}
+		d.Name = data["name"]
+		d.Address = data["address"]
+		d.Time = ev.Time
+		d.Attempts++
+	case events.ConfigSaved:
+		if c, ok := ev.Data.(config.Configuration); ok {
+			savedCfg = c
+		}
+	case events.DeviceDiscovered:
+		if data, ok := ev.Data.(map[string]interface{}); ok {
+			if id, err := protocol.DeviceIDFromString(fmt.Sprint(data["device"])); err == nil {
+				localSeen[id] = ev.Time
+			}
+		}
+	case events.FolderCompletion:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		folder, _ := data["folder"].(string)
+		id, err := protocol.DeviceIDFromString(fmt.Sprint(data["device"]))
+		if err != nil {
+			return
+		}
+		need, _ := data["needItems"].(int)
+		if remoteNeed[folder] == nil {
+			remoteNeed[folder] = make(map[protocol.DeviceID]int)
+		}
+		remoteNeed[folder][id] = need
+		if p, ok := indexProgress[id]; ok {
+			fp, ok := p.Folders[folder]
+			if !ok {
+				fp = &folderIndexProgress{}
+				p.Folders[folder] = fp
+			}
+			fp.GlobalItems, _ = data["globalItems"].(int)
+			fp.Completion, _ = data["completion"].(float64)
+		}
+	case events.FolderSummary:
+		if data, ok := ev.Data.(model.FolderSummaryEventData); ok && data.Summary != nil {
+			summaries[data.Folder] = data.Summary
+			if data.Summary.State == "idle" && data.Summary.NeedTotalItems == 0 {
+				lastSynced[data.Folder] = ev.Time
+				syncedDirty = true
+			}
+		}
+	case events.StateChanged:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		folder, _ := data["folder"].(string)
+		if data["to"] == "scanning" {
+			scanPercent[folder] = 0
+			scanChanges[folder] = &scanCounts{}
+		} else {
+			delete(scanPercent, folder)
+		}
+	case events.FolderResumed:
+		if data, ok := ev.Data.(map[string]string); ok {
+			delete(timerScanAt, data["id"])
+		}
+	case events.LocalChangeDetected:
+		data, ok := ev.Data.(map[string]string)
+		if !ok || data["type"] != "file" {
+			return
+		}
+		if c, ok := scanChanges[data["folder"]]; ok {
+			if data["action"] == "deleted" {
+				c.deleted++
+			} else {
+				c.changed++
+			}
+		}
+	case events.FolderScanProgress:
+		data, ok := ev.Data.(map[string]interface{})
+		if !ok {
+			return
+		}
+		folder, _ := data["folder"].(string)
+		current, _ := data["current"].(int64)
+		total, _ := data["total"].(int64)
+		if _, scanning := scanPercent[folder]; scanning && total > 0 {
+			scanPercent[folder] = math.Min(100, float64(current)*100/float64(total))
+		}
+	}
 }
 
-func defaultConfig(cfgPath string, myID protocol.DeviceID, evLogger events.Logger) (config.Wrapper, error) {
-	newCfg := config.New(myID)
-	newCfg.GUI.Enabled = false
-
-	// Enable local discovery so phone and desktop find each other on same WiFi
-	newCfg.Options.LocalAnnEnabled = true
-	// Listen on a dynamic TCP port for incoming connections
-	newCfg.Options.RawListenAddresses = []string{"tcp://0.0.0.0:0"}
-
-	// Keep these disabled for iOS simplicity
-	newCfg.Options.GlobalAnnEnabled = false
-	newCfg.Options.RelaysEnabled = false
-	newCfg.Options.NATEnabled = false
-	newCfg.Options.CREnabled = false
-
-	wrapper := config.Wrap(cfgPath, newCfg, myID, evLogger)
-	if err := wrapper.Save(); err != nil {
-		return nil, err
-	}
-	return wrapper, nil
+// SetConnectionHandler registers h for connection events, replacing any
+// previous handler. Pass nil to stop notifications.
+func SetConnectionHandler(h ConnectionHandler) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	connHandler = h
 }
 
-func Stop() {
-	mu.Lock()
-	defer mu.Unlock()
+// SetLowDiskSpaceHandler registers h to be told about low free space,
+// replacing any previous handler.
+func SetLowDiskSpaceHandler(h LowDiskSpaceHandler) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	lowSpaceHandler = h
+}
 
-	if app != nil {
-		app.Stop(svcutil.ExitSuccess)
-		app.Wait()
-		app = nil
+// SetLowDiskSpaceThreshold sets the free space, in bytes, below which the
+// low disk space handler is called. Defaults to 100 MiB; 0 disables it.
+func SetLowDiskSpaceThreshold(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("threshold must not be negative, got %d", bytes)
 	}
-	running = false
-}
 
-func IsRunning() bool {
 	mu.Lock()
 	defer mu.Unlock()
-	return running
+	lowDiskSpace = bytes
+	return nil
 }
 
-func GetDeviceID() string {
-	mu.Lock()
-	defer mu.Unlock()
-	return myID.String()
-}
+// watchDiskSpace checks free space for folders that are pulling and tells
+// the handler once each time a folder drops below the threshold.
+func watchDiskSpace() {
+	low := make(map[string]bool)
+	for {
+		time.Sleep(10 * time.Second)
 
-func SetFolder(folderID, folderPath string) error {
-	mu.Lock()
-	defer mu.Unlock()
+		mu.Lock()
+		if !running {
+			mu.Unlock()
+			return
+		}
+		threshold := lowDiskSpace
+		folders := cfg.FolderList()
+		mu.Unlock()
 
-	if cfg == nil {
-		addEvent("SetFolder: no config")
-		return nil
-	}
+		for _, fcfg := range folders {
+			stateMu.Lock()
+			sum, ok := summaries[fcfg.ID]
+			syncing := ok && sum.State == "syncing"
+			stateMu.Unlock()
+			if !syncing || threshold == 0 {
+				continue
+			}
 
-	addEvent(fmt.Sprintf("SetFolder: %s -> %s", folderID, folderPath))
-	_, err := cfg.Modify(func(c *config.Configuration) {
-		for i := range c.Folders {
-			if c.Folders[i].ID == folderID {
-				c.Folders[i].Path = folderPath
-				return
+			usage, err := fcfg.Filesystem(nil).Usage(".")
+			if err != nil {
+				continue
+			}
+			free := int64(usage.Free)
+			if free >= threshold {
+				low[fcfg.ID] = false
+				continue
+			}
+			if low[fcfg.ID] {
+				continue
+			}
+			low[fcfg.ID] = true
+			addEvent(fmt.Sprintf("%s low on disk space: %d bytes free", fcfg.ID, free))
+
+			handlerMu.Lock()
+			h := lowSpaceHandler
+			handlerMu.Unlock()
+			if h != nil {
+				h.OnLowDiskSpace(fcfg.ID, free)
 			}
 		}
-		c.Folders = append(c.Folders, config.FolderConfiguration{
-			ID:               folderID,
-			Path:             folderPath,
-			Type:             config.FolderTypeSendReceive,
-			FilesystemType:   fs.FilesystemTypeBasic,
-			RescanIntervalS:  10,
-			FSWatcherEnabled: true,
-		})
-	})
-	return err
+	}
 }
 
-func AddDevice(deviceID, name string) error {
-	mu.Lock()
-	defer mu.Unlock()
+func getConnectionHandler() ConnectionHandler {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	return connHandler
+}
 
-	if cfg == nil {
-		return nil
-	}
+// SetOutOfSyncHandler registers h to be told when a folder can't reach
+// full sync, replacing any previous handler.
+func SetOutOfSyncHandler(h OutOfSyncHandler) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	outOfSyncHandler = h
+}
 
-	id, err := protocol.DeviceIDFromString(deviceID)
-	if err != nil {
-		return err
-	}
+// SetScanCompleteHandler registers h to be told when a folder finishes
+// scanning, replacing any previous handler.
+func SetScanCompleteHandler(h ScanHandler) {
+	handlerMu.Lock()
+	defer handlerMu.Unlock()
+	scanHandler = h
+}
 
-	_, err = cfg.Modify(func(c *config.Configuration) {
-		for _, d := range c.Devices {
-			if d.DeviceID == id {
-				return
-			}
-		}
-		c.Devices = append(c.Devices, config.DeviceConfiguration{
-			DeviceID: id,
-			Name:     name,
-		})
-	})
-	return err
+type scanCounts struct {
+	changed, deleted int
 }
 
-func ShareFolderWithDevice(folderID, deviceID string) error {
-	mu.Lock()
-	defer mu.Unlock()
+// scanComplete passes the files counted during the folder's scan on to the
+// scan handler.
+func scanComplete(folderID string) {
+	stateMu.Lock()
+	c, ok := scanChanges[folderID]
+	delete(scanChanges, folderID)
+	stateMu.Unlock()
+	if !ok {
+		return
+	}
 
-	if cfg == nil {
-		return nil
+	handlerMu.Lock()
+	h := scanHandler
+	handlerMu.Unlock()
+	if h != nil {
+		h.OnScanComplete(folderID, c.changed, c.deleted)
 	}
+}
 
-	id, err := protocol.DeviceIDFromString(deviceID)
-	if err != nil {
-		return err
+// checkOutOfSync works out why an idle folder is below full sync and
+// reports it once per distinct reason.
+func checkOutOfSync(folderID string) {
+	mu.Lock()
+	var devices []protocol.DeviceID
+	if cfg != nil {
+		if fcfg, ok := cfg.Folder(folderID); ok {
+			for _, id := range fcfg.DeviceIDs() {
+				if id != myID {
+					devices = append(devices, id)
+				}
+			}
+		}
 	}
+	mu.Unlock()
 
-	_, err = cfg.Modify(func(c *config.Configuration) {
-		for i := range c.Folders {
-			if c.Folders[i].ID != folderID {
-				continue
+	stateMu.Lock()
+	reason := ""
+	if sum, ok := summaries[folderID]; ok && sum.State == "idle" {
+		switch {
+		case sum.Errors > 0:
+			reason = "errors"
+		case sum.NeedTotalItems > 0:
+			for _, id := range devices {
+				if !connected[id] {
+					reason = "peer offline"
+					break
+				}
 			}
-			for _, d := range c.Folders[i].Devices {
-				if d.DeviceID == id {
-					return
+		}
+		if reason == "" {
+			for id, need := range remoteNeed[folderID] {
+				if need == 0 {
+					continue
+				}
+				if !connected[id] {
+					reason = "peer offline"
+					break
 				}
+				reason = "local changes pending"
 			}
-			c.Folders[i].Devices = append(c.Folders[i].Devices, config.FolderDeviceConfiguration{
-				DeviceID: id,
-			})
-			return
 		}
-	})
-	return err
+	}
+	changed := reason != outOfSync[folderID]
+	outOfSync[folderID] = reason
+	stateMu.Unlock()
+
+	if !changed || reason == "" {
+		return
+	}
+	addEvent(fmt.Sprintf("%s out of sync: %s", folderID, reason))
+
+	handlerMu.Lock()
+	h := outOfSyncHandler
+	handlerMu.Unlock()
+	if h != nil {
+		h.OnOutOfSync(folderID, reason)
+	}
 }
 
-func Rescan(folderID string) error {
-	return nil
+// eventDescriptions covers the event types listenEvents records in the
+// event log; the skipped noisy ones are left out.
+var eventDescriptions = []struct {
+	typ  events.EventType
+	desc string
+}{
+	{events.Starting, "Engine is starting"},
+	{events.StartupComplete, "Engine has started"},
+	{events.DeviceDiscovered, "A device was found by local discovery"},
+	{events.DeviceConnected, "A device connected"},
+	{events.DeviceDisconnected, "A device disconnected"},
+	{events.DeviceRejected, "An unknown device tried to connect"},
+	{events.PendingDevicesChanged, "Devices waiting to be accepted changed"},
+	{events.DevicePaused, "A device was paused"},
+	{events.DeviceResumed, "A device was resumed"},
+	{events.ClusterConfigReceived, "A device sent its folder list"},
+	{events.LocalChangeDetected, "A local file changed"},
+	{events.RemoteChangeDetected, "A remote change was applied locally"},
+	{events.RemoteIndexUpdated, "A device sent index updates"},
+	{events.ItemStarted, "Started syncing an item"},
+	{events.ItemFinished, "Finished syncing an item"},
+	{events.StateChanged, "A folder changed state, e.g. idle to syncing"},
+	{events.FolderRejected, "A device offered an unknown folder"},
+	{events.PendingFoldersChanged, "Folders waiting to be accepted changed"},
+	{events.DownloadProgress, "Progress of files being downloaded"},
+	{events.RemoteDownloadProgress, "Progress of a device downloading from us"},
+	{events.FolderCompletion, "A device's completion of a folder changed"},
+	{events.FolderErrors, "Items in a folder failed to sync"},
+	{events.FolderScanProgress, "Progress of a folder scan"},
+	{events.FolderPaused, "A folder was paused"},
+	{events.FolderResumed, "A folder was resumed"},
+	{events.FolderWatchStateChanged, "A folder's watcher started or failed"},
+	{events.ListenAddressesChanged, "Our listen addresses changed"},
+	{events.LoginAttempt, "Someone tried to log in to the GUI"},
+	{events.Failure, "An internal failure was reported"},
+}
+
+// ListEventTypes returns the event type names that can appear in the event
+// log, each with a short description, as JSON.
+func ListEventTypes() string {
+	type eventType struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	list := make([]eventType, 0, len(eventDescriptions))
+	for _, e := range eventDescriptions {
+		list = append(list, eventType{Name: e.typ.String(), Description: e.desc})
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return ""
+	}
+	return string(data)
 }
 
 func listenEvents() {
@@ -296,18 +6696,56 @@ func listenEvents() {
 			continue
 		}
 
+		updateState(ev)
+
+		eventMu.Lock()
+		eventCounts[ev.Type]++
+		eventMu.Unlock()
+
+		switch ev.Type {
+		case events.FolderSummary:
+			if data, ok := ev.Data.(model.FolderSummaryEventData); ok {
+				checkOutOfSync(data.Folder)
+			}
+		case events.FolderCompletion:
+			if data, ok := ev.Data.(map[string]interface{}); ok {
+				checkOutOfSync(fmt.Sprint(data["folder"]))
+			}
+		case events.ItemStarted:
+			if data, ok := ev.Data.(map[string]string); ok && data["type"] == "file" && data["action"] == "update" {
+				go hideTempFile(data["folder"], data["item"])
+			}
+		case events.StateChanged:
+			if data, ok := ev.Data.(map[string]interface{}); ok && data["from"] == "scanning" && data["to"] != "error" {
+				scanComplete(fmt.Sprint(data["folder"]))
+			} else if ok && data["to"] == "scanning" {
+				recordScanTrigger(fmt.Sprint(data["folder"]), ev.Time)
+			}
+		}
+
 		var msg string
 		switch ev.Type {
 		case events.StartupComplete:
 			msg = "Ready"
 		case events.DeviceConnected:
-			if data, ok := ev.Data.(map[string]interface{}); ok {
-				if id, ok := data["id"].(string); ok && len(id) > 7 {
-					msg = fmt.Sprintf("Connected to %s", id[:7])
+			if data, ok := ev.Data.(map[string]string); ok {
+				if id := data["id"]; len(id) > 7 {
+					msg = fmt.Sprintf("Connected to %s (%s %s)", id[:7], data["type"], data["addr"])
+				}
+				if h := getConnectionHandler(); h != nil {
+					h.OnConnected(data["id"], data["addr"], data["type"])
 				}
 			}
 		case events.DeviceDisconnected:
 			msg = "Device disconnected"
+			if data, ok := ev.Data.(map[string]string); ok {
+				if id := data["id"]; len(id) > 7 {
+					msg = fmt.Sprintf("Disconnected from %s: %s", id[:7], data["error"])
+				}
+				if h := getConnectionHandler(); h != nil {
+					h.OnDisconnected(data["id"], data["error"])
+				}
+			}
 		case events.StateChanged:
 			if data, ok := ev.Data.(map[string]interface{}); ok {
 				to := data["to"]
@@ -337,7 +6775,7 @@ func listenEvents() {
 					}
 				}
 			}
-		case events.ConfigSaved, events.LocalIndexUpdated:
+		case events.ConfigSaved, events.LocalIndexUpdated, events.FolderSummary:
 			// skip noisy events
 		default:
 			msg = ev.Type.String()
@@ -374,3 +6812,20 @@ func GetEvents() string {
 	eventLog = nil
 	return result
 }
+
+// GetEventCounts returns how many engine events of each type have occurred
+// since Start as JSON, keyed by event type name.
+func GetEventCounts() string {
+	eventMu.Lock()
+	counts := make(map[string]int, len(eventCounts))
+	for t, n := range eventCounts {
+		counts[t.String()] = n
+	}
+	eventMu.Unlock()
+
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
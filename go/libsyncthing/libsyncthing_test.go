@@ -0,0 +1,198 @@
+package libsyncthing
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncthing/syncthing/lib/protocol"
+)
+
+func TestValidateDeviceID(t *testing.T) {
+	id := protocol.NewDeviceID([]byte("libsyncthing test certificate")).String()
+	plain := strings.ReplaceAll(id, "-", "")
+	var noCheck strings.Builder
+	for i := 0; i < 4; i++ {
+		noCheck.WriteString(plain[i*14 : i*14+13])
+	}
+	wrongCheck := []byte(plain)
+	if wrongCheck[13] == 'A' {
+		wrongCheck[13] = 'B'
+	} else {
+		wrongCheck[13] = 'A'
+	}
+
+	cases := []struct {
+		in   string
+		want error
+	}{
+		{id, nil},
+		{strings.ToLower(id), nil},
+		{"  " + strings.ReplaceAll(id, "-", " ") + "  ", nil},
+		{"", ErrDeviceIDEmpty},
+		{" - ", ErrDeviceIDEmpty},
+		{noCheck.String(), ErrDeviceIDNoCheckDigits},
+		{"ABCDEFG", ErrDeviceIDLength},
+		{strings.Replace(plain, plain[:1], "!", 1), ErrDeviceIDCharacters},
+		{string(wrongCheck), ErrDeviceIDChecksum},
+	}
+	for _, c := range cases {
+		if err := ValidateDeviceID(c.in); !errors.Is(err, c.want) {
+			t.Errorf("ValidateDeviceID(%q) = %v, want %v", c.in, err, c.want)
+		}
+	}
+}
+
+func TestPathsOverlap(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"/data/photos", "/data/photos", true},
+		{"/data/photos/", "/data/photos", true},
+		{"/data/photos", "/data/photos/2024", true},
+		{"/data/photos/2024", "/data/photos", true},
+		{"/data/photos", "/data/photos-old", false},
+		{"/data/photos", "/data/music", false},
+		{"/data/./photos", "/data/photos", true},
+	}
+	for _, c := range cases {
+		if got := pathsOverlap(c.a, c.b); got != c.want {
+			t.Errorf("pathsOverlap(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestBandwidthWindowActive(t *testing.T) {
+	at := func(hour int) time.Time {
+		return time.Date(2024, 1, 1, hour, 30, 0, 0, time.Local)
+	}
+	cases := []struct {
+		start, end, hour int
+		want             bool
+	}{
+		{9, 17, 9, true},
+		{9, 17, 16, true},
+		{9, 17, 17, false},
+		{9, 17, 8, false},
+		{22, 6, 23, true},
+		{22, 6, 0, true},
+		{22, 6, 5, true},
+		{22, 6, 6, false},
+		{22, 6, 21, false},
+		{0, 0, 12, true},
+	}
+	for _, c := range cases {
+		w := bandwidthWindow{start: c.start, end: c.end}
+		if got := w.active(at(c.hour)); got != c.want {
+			t.Errorf("window %d-%d at %d:30 active = %v, want %v", c.start, c.end, c.hour, got, c.want)
+		}
+	}
+}
+
+func TestEscapeIgnorePattern(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"dir/file name.txt", "dir/file name.txt"},
+		{"*.log", `\*.log`},
+		{"what?", `what\?`},
+		{"[draft]{1}", `\[draft\]\{1\}`},
+		{`back\slash`, `back\\slash`},
+		{"!important", "!important"},
+	}
+	for _, c := range cases {
+		if got := escapeIgnorePattern(c.in); got != c.want {
+			t.Errorf("escapeIgnorePattern(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := []struct {
+		in   float64
+		want string
+	}{
+		{0, "0 B"},
+		{999, "999 B"},
+		{1000, "1.0 KB"},
+		{1234, "1.2 KB"},
+		{123456, "123 KB"},
+		{1.5e9, "1.5 GB"},
+		{2e15, "2000 TB"},
+	}
+	for _, c := range cases {
+		if got := formatBytes(c.in); got != c.want {
+			t.Errorf("formatBytes(%v) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestUnderAny(t *testing.T) {
+	cases := []struct {
+		name  string
+		paths []string
+		want  bool
+	}{
+		{"a/b.txt", []string{"a"}, true},
+		{"a/b.txt", []string{"a/b.txt"}, true},
+		{"a/b.txt", []string{"/a/"}, true},
+		{"ab/c.txt", []string{"a"}, false},
+		{"a/b.txt", []string{"b", "c"}, false},
+		{"a/b.txt", []string{"."}, true},
+		{"a/b.txt", nil, false},
+	}
+	for _, c := range cases {
+		if got := underAny(c.name, c.paths); got != c.want {
+			t.Errorf("underAny(%q, %q) = %v, want %v", c.name, c.paths, got, c.want)
+		}
+	}
+}
+
+func TestTransportName(t *testing.T) {
+	cases := []struct {
+		in, want string
+	}{
+		{"tcp", "tcp"},
+		{"tcp4", "tcp"},
+		{"tcp6", "tcp"},
+		{"tcp-client", "tcp"},
+		{"tcp-server", "tcp"},
+		{"quic4", "quic"},
+		{"quic-client", "quic"},
+		{"relay-client", "relay"},
+	}
+	for _, c := range cases {
+		if got := transportName(c.in); got != c.want {
+			t.Errorf("transportName(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestStartInMemory(t *testing.T) {
+	id, err := StartInMemory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	tmpDir := memoryBaseDir
+	mu.Unlock()
+
+	if err := ValidateDeviceID(id); err != nil {
+		t.Errorf("device ID %q: %v", id, err)
+	}
+	if again, err := StartInMemory(); err != nil || again != id {
+		t.Errorf("second StartInMemory = %q, %v; want %q, nil", again, err, id)
+	}
+	if err := Start(t.TempDir()); !errors.Is(err, ErrAlreadyRunning) {
+		t.Errorf("Start while in memory = %v, want %v", err, ErrAlreadyRunning)
+	}
+
+	Stop()
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory %s left behind after Stop: %v", tmpDir, err)
+	}
+}